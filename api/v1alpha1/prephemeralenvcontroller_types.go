@@ -43,7 +43,95 @@ type PREphemeralEnvControllerSpec struct {
 	// Ephemeral Environment Health Check URL Template to be used to check the health of the ephemeral environment. If specified, the controller will check the health of the ephemeral environment and Update the Github PR status when environment is ready.
 	// <<PR_NUMBER>> will be replaced with the PR number
 	// <<PR_HEAD_SHA>> will be replaced with the PR head SHA
+	// Deprecated: use healthCheck instead, this field is ignored if healthCheck is set
 	EnvHealthCheckURLTemplate string `json:"envHealthCheckURLTemplate,omitempty"`
+
+	// Health check of the ephemeral environment of each PR. If specified, the controller probes the environment and
+	// updates the Github PR status when the environment is ready
+	// +optional
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// Named health checks of the ephemeral environment of each PR, like one check for each service of the environment.
+	// The environment is ready once all checks which are not optional pass
+	// +optional
+	HealthChecks []HealthCheck `json:"healthChecks,omitempty"`
+
+	// Time after which an environment which did not pass its health checks since it was deployed is marked as Failed,
+	// and the Github PR status is set to failure. Failed environments are probed with a slower backoff. Defaults to
+	// waiting indefinitely
+	// +optional
+	ReadinessTimeout *metav1.Duration `json:"readinessTimeout,omitempty"`
+
+	// Job run against the environment of a PR once its health checks pass, for instance to run Postman or k6 tests.
+	// The Github PR status is only set to success once the Job succeeded. It runs again for every new commit of the PR
+	// +optional
+	SmokeTest *HookJob `json:"smokeTest,omitempty"`
+
+	// Maximum number of PR HelmReleases which are upgraded at once, when changes to the spec (like a chart version bump)
+	// are rolled out to existing environments. Updates caused by new PR commits are not limited. 0 means no limit
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxConcurrentUpgrades int `json:"maxConcurrentUpgrades,omitempty"`
+
+	// Maximum lifetime of a PR environment. Once the environment is older than the ttl it is removed, and is
+	// recreated when a new commit is pushed to the PR
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// A PR environment is removed when no new commits have been pushed to the PR for this duration, and is
+	// recreated when a new commit is pushed to the PR
+	// +optional
+	IdleTimeout *metav1.Duration `json:"idleTimeout,omitempty"`
+
+	// Maximum number of PR environments which can exist at once. Environments for further PRs are queued until
+	// an environment is removed. 0 means no limit
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxEnvironments int `json:"maxEnvironments,omitempty"`
+
+	// Policy used to give free environment slots to the queued PRs, when maxEnvironments is set.
+	// OldestFirst gives slots to the oldest PRs first, LabelPriority gives slots to PRs with the labels listed
+	// earlier in priorityLabels first, and then to the oldest PRs first
+	// +kubebuilder:validation:Enum=OldestFirst;LabelPriority
+	// +kubebuilder:default="OldestFirst"
+	// +optional
+	QueuePolicy string `json:"queuePolicy,omitempty"`
+
+	// PR labels in descending order of priority, used by the LabelPriority queue policy
+	// +optional
+	PriorityLabels []string `json:"priorityLabels,omitempty"`
+
+	// Duration for which the environment of a PR is kept after the PR was closed or merged, before it is deleted.
+	// If the PR is reopened within the grace period the environment is kept. Defaults to deleting immediately
+	// +optional
+	DeletionGracePeriod *metav1.Duration `json:"deletionGracePeriod,omitempty"`
+
+	// Policy applied to the environment of a PR once the PR is merged. Defaults to deleting the environment
+	// +optional
+	OnMerged *TeardownPolicy `json:"onMerged,omitempty"`
+
+	// Policy applied to the environment of a PR once the PR is closed without being merged. Defaults to deleting
+	// the environment
+	// +optional
+	OnClosed *TeardownPolicy `json:"onClosed,omitempty"`
+
+	// Jobs run after the environment of a PR comes up, and before it is deleted
+	// +optional
+	Hooks *Hooks `json:"hooks,omitempty"`
+
+	// If specified, PR environments are hibernated outside the active windows of the schedule
+	// +optional
+	Schedule *HibernationSchedule `json:"schedule,omitempty"`
+
+	// If specified, the controller creates a namespace for each PR, which is used as the target namespace of the PR HelmRelease.
+	// The namespace is deleted once the HelmRelease of the PR has been uninstalled
+	// +optional
+	PRNamespace *PRNamespace `json:"prNamespace,omitempty"`
+
+	// Suspend tells the controller to stop creating, updating and deleting HelmReleases and the other objects of the
+	// PR environments. PRs are still observed and the status is still updated. Defaults to false
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // PREphemeralEnvControllerStatus defines the observed state of PREphemeralEnvController
@@ -55,6 +143,10 @@ type PREphemeralEnvControllerStatus struct {
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 	Message    string             `json:"message,omitempty"`
+
+	// Environments holds the observed state of the ephemeral environment of each PR
+	// +optional
+	Environments []PREnvironmentStatus `json:"environments,omitempty"`
 }
 
 //+kubebuilder:object:root=true
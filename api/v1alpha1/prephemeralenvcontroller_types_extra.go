@@ -16,6 +16,14 @@ limitations under the License.
 
 package v1alpha1
 
+import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
 // The Github Token Secret
 type SecretRef struct {
 	// Name of the referent.
@@ -63,4 +71,492 @@ type EnvCreationHelmRepo struct {
 	// +required
 	// +kubebuilder:default="pr-helm-releases"
 	DestinationNamespace string `json:"destinationNamespace"`
+
+	// Static Helm values passed to the chart of every PR environment
+	// +optional
+	Values *apiextensionsv1.JSON `json:"values,omitempty"`
+
+	// Go template of a YAML block of Helm values, rendered for each PR and merged over the static values.
+	// The template is passed .Number, .HeadSHA, .ShortSHA, .Branch, .Author, .Labels and .TitleSlug
+	// +optional
+	ValuesTemplate string `json:"valuesTemplate,omitempty"`
+
+	// References to ConfigMaps and Secrets in the destination namespace, containing values which are copied
+	// into the valuesFrom of every PR HelmRelease
+	// +optional
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty"`
+
+	// If specified, the Secrets referenced in valuesFrom are copied from this namespace to the destination namespace,
+	// as Flux needs them to be in the same namespace as the HelmRelease. It must be the namespace of the
+	// PREphemeralEnvController, or one of the namespaces allowed with the --secret-source-namespaces flag
+	// +optional
+	CopySecretsFromNamespace string `json:"copySecretsFromNamespace,omitempty"`
+
+	// Partial Flux HelmRelease spec (install, upgrade, rollback, test, targetNamespace, dependsOn etc.) which is
+	// deep merged into the spec of every generated HelmRelease. Fields conflicting with the generated spec are rejected.
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	HelmReleaseTemplate *apiextensionsv1.JSON `json:"helmReleaseTemplate,omitempty"`
+}
+
+// ValuesReference references a ConfigMap or Secret containing Helm values for the PR HelmReleases
+type ValuesReference struct {
+	// Kind of the values referent, valid values are ('Secret', 'ConfigMap').
+	// +kubebuilder:validation:Enum=Secret;ConfigMap
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the values referent
+	// +required
+	Name string `json:"name"`
+
+	// The data key where the values.yaml or a specific value can be found at. Defaults to 'values.yaml'.
+	// +optional
+	ValuesKey string `json:"valuesKey,omitempty"`
+
+	// The YAML dot notation path the value should be merged at. Defaults to the values root.
+	// +optional
+	TargetPath string `json:"targetPath,omitempty"`
+
+	// Optional marks this reference as optional, a missing referent is then ignored
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+}
+
+// PRNamespace defines the namespace created by the controller for each PR
+type PRNamespace struct {
+	// Template for the name of the namespace
+	// <<PR_NUMBER>> will be replaced with the PR number, and is required. <<PR_HEAD_SHA>> is not allowed, as the
+	// namespace must be the same for every commit of the PR. Existing namespaces which were not created by the
+	// controller are not adopted
+	// +kubebuilder:default="pr-<<PR_NUMBER>>"
+	NameTemplate string `json:"nameTemplate,omitempty"`
+
+	// Labels added to the namespace
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ResourceQuota created in the namespace
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	ResourceQuota *corev1.ResourceQuotaSpec `json:"resourceQuota,omitempty"`
+
+	// LimitRange created in the namespace
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	LimitRange *corev1.LimitRangeSpec `json:"limitRange,omitempty"`
+
+	// NetworkPolicy created in the namespace
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	NetworkPolicy *networkingv1.NetworkPolicySpec `json:"networkPolicy,omitempty"`
+
+	// RoleBindings created in the namespace
+	// +optional
+	RoleBindings []PRNamespaceRoleBinding `json:"roleBindings,omitempty"`
+}
+
+// PRNamespaceRoleBinding defines a RoleBinding created in the PR namespace
+type PRNamespaceRoleBinding struct {
+	// Name of the RoleBinding
+	// +required
+	Name string `json:"name"`
+
+	// The Role or ClusterRole which is bound
+	// +required
+	RoleRef rbacv1.RoleRef `json:"roleRef"`
+
+	// The subjects the role is bound to
+	// +optional
+	Subjects []rbacv1.Subject `json:"subjects,omitempty"`
+}
+
+// Phases of the ephemeral environment of a PR
+const (
+	// The environment has been created for the PR
+	EnvPhaseActive = "Active"
+	// The environment has been removed after the ttl or idle timeout expired
+	EnvPhaseExpired = "Expired"
+	// The environment is waiting for capacity, as maxEnvironments has been reached
+	EnvPhaseQueued = "Queued"
+	// The environment is hibernated, as it is outside the active windows of the schedule
+	EnvPhaseHibernated = "Hibernated"
+	// The environment did not pass its health checks within the readiness timeout
+	EnvPhaseFailed = "Failed"
+)
+
+// Conditions of the PREphemeralEnvController
+const (
+	// The controller is backing off from Github until the API rate limit resets, the message holds the reset time
+	RateLimitedCondition = "RateLimited"
+)
+
+// Teardown actions for the environment of a PR once the PR is merged or closed
+const (
+	TeardownActionDelete             = "Delete"
+	TeardownActionRetain             = "Retain"
+	TeardownActionSnapshotThenDelete = "SnapshotThenDelete"
+)
+
+// Outcomes of PRs which are no longer open
+const (
+	PROutcomeMerged = "Merged"
+	PROutcomeClosed = "Closed"
+)
+
+// TeardownPolicy defines what happens to the environment of a PR once the PR is merged or closed
+type TeardownPolicy struct {
+	// Delete deletes the environment once the deletionGracePeriod has passed. Retain keeps the environment for
+	// retainFor. SnapshotThenDelete creates VolumeSnapshots of the PersistentVolumeClaims of the release once the
+	// deletionGracePeriod has passed, and deletes the environment when the snapshots are ready to use
+	// +kubebuilder:validation:Enum=Delete;Retain;SnapshotThenDelete
+	// +kubebuilder:default="Delete"
+	// +optional
+	Action string `json:"action,omitempty"`
+
+	// Duration for which the environment is kept with the Retain action. If not set the environment is kept
+	// until its HelmRelease is deleted manually
+	// +optional
+	RetainFor *metav1.Duration `json:"retainFor,omitempty"`
+
+	// Name of the VolumeSnapshotClass used with the SnapshotThenDelete action, the default class is used if not set
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// Results of the hook Jobs of an environment
+const (
+	HookResultRunning   = "Running"
+	HookResultSucceeded = "Succeeded"
+	HookResultFailed    = "Failed"
+	HookResultTimedOut  = "TimedOut"
+)
+
+// Hooks defines the Jobs run during the lifecycle of the environment of a PR
+type Hooks struct {
+	// Job run in the destination namespace once the HelmRelease of a new environment is ready, for instance to seed data
+	// +optional
+	PostCreate *HookJob `json:"postCreate,omitempty"`
+
+	// Job run in the destination namespace before the environment is deleted, for instance to dump a database.
+	// Deletion waits for the Job to finish, or for its timeout to pass
+	// +optional
+	PreDelete *HookJob `json:"preDelete,omitempty"`
+}
+
+// HookJob defines a Job run for the environment of a PR
+type HookJob struct {
+	// Go template of the Job spec in YAML. It is rendered with the same PR metadata as the valuesTemplate
+	// of the envCreationHelmRepo, like {{ .Number }} and {{ .HeadSHA }}
+	JobTemplate string `json:"jobTemplate"`
+
+	// Maximum time to wait for the Job to finish
+	// +kubebuilder:default="10m"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// HealthCheck defines how the ephemeral environment of a PR is probed to find out if it is ready
+type HealthCheck struct {
+	// Name of the check, required for the checks listed in healthChecks
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Optional checks are probed and reported, but the environment can be ready while they fail
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+
+	// Type of the probe. http requests the URL, tcp opens a connection to the address, grpc calls the standard gRPC
+	// health checking protocol on the address, and dns resolves the host name
+	// +kubebuilder:validation:Enum=http;tcp;grpc;dns
+	// +kubebuilder:default="http"
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// URL to probe, or host:port for tcp and grpc probes and the host name for dns probes. <<PR_NUMBER>> and
+	// <<PR_HEAD_SHA>> are replaced with the PR number and head SHA. Either urlTemplate or service is required
+	// +optional
+	URLTemplate string `json:"urlTemplate,omitempty"`
+
+	// Kubernetes Service to probe instead of the urlTemplate, so that environments which are only reachable inside
+	// the cluster can be probed
+	// +optional
+	Service *ServiceTarget `json:"service,omitempty"`
+
+	// Service name sent in grpc probes, the overall health of the server is checked if not set
+	// +optional
+	GRPCService string `json:"grpcService,omitempty"`
+
+	// Use TLS for grpc probes
+	// +optional
+	TLS bool `json:"tls,omitempty"`
+
+	// HTTP method of the probe
+	// +kubebuilder:validation:Enum=GET;HEAD;POST
+	// +kubebuilder:default="GET"
+	// +optional
+	Method string `json:"method,omitempty"`
+
+	// HTTP headers sent with the probe, sent as metadata with grpc probes
+	// +optional
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Secret key holding a bearer token, sent in the Authorization header of the probe. The Secret must be in the
+	// namespace of the PREphemeralEnvController, the namespace of the reference is ignored
+	// +optional
+	BearerTokenSecretRef *SecretRef `json:"bearerTokenSecretRef,omitempty"`
+
+	// Status codes for which the probe succeeds. Defaults to 200
+	// +optional
+	AcceptedStatusCodes []int `json:"acceptedStatusCodes,omitempty"`
+
+	// Regular expression the response body has to match for the probe to succeed
+	// +optional
+	BodyRegex string `json:"bodyRegex,omitempty"`
+
+	// Timeout of the probe
+	// +kubebuilder:default="2s"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Number of consecutive successful probes required for the environment to be ready
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	SuccessThreshold int `json:"successThreshold,omitempty"`
+}
+
+// Ways of reaching the Service probed by a health check
+const (
+	ServiceAccessInCluster      = "InCluster"
+	ServiceAccessAPIServerProxy = "APIServerProxy"
+)
+
+// ServiceTarget references the Kubernetes Service probed by a health check. <<PR_NUMBER>> and <<PR_HEAD_SHA>> are
+// replaced in the namespace, name and path
+type ServiceTarget struct {
+	// Namespace of the Service, defaults to the namespace the environment of the PR is deployed to
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the Service
+	// +required
+	Name string `json:"name"`
+
+	// Port of the Service
+	// +required
+	Port int32 `json:"port"`
+
+	// Path requested by http probes
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Scheme used by http probes
+	// +kubebuilder:validation:Enum=http;https
+	// +kubebuilder:default="http"
+	// +optional
+	Scheme string `json:"scheme,omitempty"`
+
+	// How the Service is reached. InCluster uses the cluster DNS name of the Service, which requires the controller to
+	// run in the cluster. APIServerProxy goes through the service proxy of the Kubernetes API server, and only supports
+	// http probes without a bearer token
+	// +kubebuilder:validation:Enum=InCluster;APIServerProxy
+	// +kubebuilder:default="InCluster"
+	// +optional
+	Access string `json:"access,omitempty"`
+}
+
+// ReportedPRStatus is a Github commit status reported for a PR, used to skip reporting the same status again
+type ReportedPRStatus struct {
+	// Context of the status, empty for the default context
+	// +optional
+	Context string `json:"context,omitempty"`
+
+	// The commit SHA the status was reported for
+	SHA string `json:"sha"`
+
+	// State of the status, like pending or success
+	State string `json:"state"`
+
+	// Description of the status
+	// +optional
+	Description string `json:"description,omitempty"`
+}
+
+// ProbeStatus is the result of the last probe of a health check of the environment of a PR
+type ProbeStatus struct {
+	// Name of the health check
+	Name string `json:"name"`
+
+	// Time of the probe
+	Time metav1.Time `json:"time"`
+
+	// Whether the probe succeeded
+	Success bool `json:"success"`
+
+	// HTTP status code of the response, if any
+	// +optional
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Reason the probe failed
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Number of consecutive successful probes
+	// +optional
+	ConsecutiveSuccesses int `json:"consecutiveSuccesses,omitempty"`
+}
+
+// Health check probe types
+const (
+	ProbeTypeHTTP = "http"
+	ProbeTypeTCP  = "tcp"
+	ProbeTypeGRPC = "grpc"
+	ProbeTypeDNS  = "dns"
+)
+
+// Hibernation modes
+const (
+	HibernationModeHibernatedValue = "HibernatedValue"
+	HibernationModeScaleDown       = "ScaleDown"
+)
+
+// Queue policies for PRs waiting for an environment
+const (
+	QueuePolicyOldestFirst   = "OldestFirst"
+	QueuePolicyLabelPriority = "LabelPriority"
+)
+
+// HibernationSchedule defines when PR environments are active. Outside the active windows, environments are
+// hibernated without being destroyed
+type HibernationSchedule struct {
+	// Windows during which the PR environments are active
+	// +required
+	ActiveWindows []ActiveWindow `json:"activeWindows"`
+
+	// IANA time zone in which the cron expressions of the active windows are evaluated, like "Europe/Berlin"
+	// +kubebuilder:default="UTC"
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// How environments are hibernated. HibernatedValue sets the "hibernated: true" Helm value and suspends the
+	// HelmRelease once Flux has applied it, the chart is expected to scale itself down. ScaleDown suspends the
+	// HelmRelease and scales the Deployments and StatefulSets of the release to zero
+	// +kubebuilder:validation:Enum=HibernatedValue;ScaleDown
+	// +kubebuilder:default="HibernatedValue"
+	// +optional
+	Mode string `json:"mode,omitempty"`
+
+	// Duration for which a hibernated environment is woken up when a new commit is pushed to the PR
+	// +kubebuilder:default="2h"
+	// +optional
+	WakeOnCommitDuration *metav1.Duration `json:"wakeOnCommitDuration,omitempty"`
+}
+
+// ActiveWindow defines a recurring window during which the PR environments are active
+type ActiveWindow struct {
+	// Cron expression for the start of the window, like "0 8 * * 1-5"
+	// +required
+	Start string `json:"start"`
+
+	// Duration of the window, like "11h"
+	// +required
+	Duration metav1.Duration `json:"duration"`
+}
+
+// PREnvironmentStatus defines the observed state of the ephemeral environment of a PR
+type PREnvironmentStatus struct {
+	// The PR number
+	PRNumber int `json:"prNumber"`
+
+	// The PR head SHA the environment was last deployed for
+	// +optional
+	HeadSHA string `json:"headSHA,omitempty"`
+
+	// The phase of the environment
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// Time at which the environment was created
+	// +optional
+	CreatedAt *metav1.Time `json:"createdAt,omitempty"`
+
+	// Time at which the last commit of the PR was deployed
+	// +optional
+	LastCommitAt *metav1.Time `json:"lastCommitAt,omitempty"`
+
+	// Time at which the environment expires, based on the ttl and idleTimeout
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Time until which a hibernated environment stays awake, after it was woken up by a new commit
+	// +optional
+	AwakeUntil *metav1.Time `json:"awakeUntil,omitempty"`
+
+	// Time at which the PR was closed or merged
+	// +optional
+	ClosedAt *metav1.Time `json:"closedAt,omitempty"`
+
+	// Merged or Closed, once the PR is no longer open
+	// +optional
+	Outcome string `json:"outcome,omitempty"`
+
+	// The merge commit SHA of the PR, once the PR is merged
+	// +optional
+	MergeCommitSHA string `json:"mergeCommitSHA,omitempty"`
+
+	// Result of the postCreate hook Job of the environment
+	// +optional
+	PostCreateHook string `json:"postCreateHook,omitempty"`
+
+	// Time of the first attempt to run the postCreate hook Job, from which the timeout of the postCreate hook is measured
+	// +optional
+	PostCreateHookStartedAt *metav1.Time `json:"postCreateHookStartedAt,omitempty"`
+
+	// Result of the preDelete hook Job of the environment
+	// +optional
+	PreDeleteHook string `json:"preDeleteHook,omitempty"`
+
+	// Time of the first attempt to run the preDelete hook Job, from which the timeout of the preDelete hook is measured
+	// +optional
+	PreDeleteHookStartedAt *metav1.Time `json:"preDeleteHookStartedAt,omitempty"`
+
+	// Result of the smoke test Job for the deployed head SHA
+	// +optional
+	SmokeTest string `json:"smokeTest,omitempty"`
+
+	// Time of the first attempt to run the smoke test Job, from which the timeout of the smoke test is measured
+	// +optional
+	SmokeTestStartedAt *metav1.Time `json:"smokeTestStartedAt,omitempty"`
+
+	// Result of the last probe of each health check of the environment
+	// +optional
+	HealthChecks []ProbeStatus `json:"healthChecks,omitempty"`
+
+	// Time at which the environment first passed its health checks since it was deployed
+	// +optional
+	ReadyAt *metav1.Time `json:"readyAt,omitempty"`
+
+	// Time at which the environment was marked as Failed, as it did not pass its health checks within the readiness
+	// timeout
+	// +optional
+	FailedAt *metav1.Time `json:"failedAt,omitempty"`
+
+	// Set if changes to the environment are skipped, because the controller is suspended or the environment is frozen
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+
+	// The Github commit statuses last reported for the PR, one for each status context
+	// +optional
+	ReportedStatuses []ReportedPRStatus `json:"reportedStatuses,omitempty"`
+
+	// Human readable message about the phase of the environment
+	// +optional
+	Message string `json:"message,omitempty"`
 }
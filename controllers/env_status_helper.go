@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Returns the status of the environment of the PR from the controller status, or nil if there is none
+func findPREnvStatus(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int) *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus {
+	for i := range prController.Status.Environments {
+		if prController.Status.Environments[i].PRNumber == prNumber {
+			return &prController.Status.Environments[i]
+		}
+	}
+	return nil
+}
+
+// Returns the status of the environment of the PR from the controller status, adding a new entry if none exists yet
+func getPREnvStatus(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int) *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus {
+	if envStatus := findPREnvStatus(prController, prNumber); envStatus != nil {
+		return envStatus
+	}
+	prController.Status.Environments = append(prController.Status.Environments, prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{PRNumber: prNumber})
+	return &prController.Status.Environments[len(prController.Status.Environments)-1]
+}
+
+// Removes the status entries of PRs which are no longer open, and for which no HelmRelease exists anymore.
+// The remaining entries are sorted by PR number
+func prunePREnvStatuses(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prDetails map[int]PRDetails, helmReleases map[int]fluxhelmrelease.HelmRelease) {
+	var environments []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus
+	for _, envStatus := range prController.Status.Environments {
+		_, prOpen := prDetails[envStatus.PRNumber]
+		_, helmRelExists := helmReleases[envStatus.PRNumber]
+		if prOpen || helmRelExists {
+			environments = append(environments, envStatus)
+		}
+	}
+	sort.Slice(environments, func(i, j int) bool {
+		return environments[i].PRNumber < environments[j].PRNumber
+	})
+	prController.Status.Environments = environments
+}
+
+// Returns true if the same Github commit status was already reported for the PR status context and SHA
+func isPRStatusReported(envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, statusContext string, sha string, state string, description string) bool {
+	for _, reported := range envStatus.ReportedStatuses {
+		if reported.Context == statusContext {
+			return reported.SHA == sha && reported.State == state && reported.Description == description
+		}
+	}
+	return false
+}
+
+// Records the Github commit status reported for the PR status context, replacing the status previously reported
+func recordPRStatus(envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, statusContext string, sha string, state string, description string) {
+	reported := prcontrollerephemeralenviov1alpha1.ReportedPRStatus{Context: statusContext, SHA: sha, State: state, Description: description}
+	for i := range envStatus.ReportedStatuses {
+		if envStatus.ReportedStatuses[i].Context == statusContext {
+			envStatus.ReportedStatuses[i] = reported
+			return
+		}
+	}
+	envStatus.ReportedStatuses = append(envStatus.ReportedStatuses, reported)
+}
+
+// Records that the environment of the PR has been deployed for the PR head SHA
+func markPREnvDeployed(envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prDetails PRDetails, now metav1.Time) {
+	if envStatus.CreatedAt == nil || envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseExpired ||
+		envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseQueued {
+		envStatus.CreatedAt = &now
+		envStatus.PostCreateHook = ""
+		envStatus.PostCreateHookStartedAt = nil
+		envStatus.PreDeleteHook = ""
+		envStatus.PreDeleteHookStartedAt = nil
+	}
+	// A postCreate hook which did not succeed runs again for the new commit, which may fix it
+	if envStatus.PostCreateHook != prcontrollerephemeralenviov1alpha1.HookResultSucceeded {
+		envStatus.PostCreateHook = ""
+		envStatus.PostCreateHookStartedAt = nil
+	}
+	envStatus.LastCommitAt = &now
+	envStatus.HeadSHA = prDetails.HeadSHA
+	envStatus.HealthChecks = nil
+	envStatus.ReadyAt = nil
+	envStatus.SmokeTest = ""
+	envStatus.SmokeTestStartedAt = nil
+	envStatus.FailedAt = nil
+	envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseActive
+	envStatus.Message = ""
+}
+
+// Computes the expiry time of the environment from the ttl and idleTimeout in the CRD. The reason the environment
+// expires at that time is returned along with it, nil is returned if the environment does not expire.
+func getPREnvExpiry(spec prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus) (*metav1.Time, string) {
+	var expiresAt *metav1.Time
+	var reason string
+
+	if spec.TTL != nil && spec.TTL.Duration > 0 && envStatus.CreatedAt != nil {
+		ttlExpiry := metav1.NewTime(envStatus.CreatedAt.Add(spec.TTL.Duration))
+		expiresAt = &ttlExpiry
+		reason = fmt.Sprintf("environment is older than the ttl of %s", spec.TTL.Duration)
+	}
+	if spec.IdleTimeout != nil && spec.IdleTimeout.Duration > 0 && envStatus.LastCommitAt != nil {
+		idleExpiry := metav1.NewTime(envStatus.LastCommitAt.Add(spec.IdleTimeout.Duration))
+		if expiresAt == nil || idleExpiry.Before(expiresAt) {
+			expiresAt = &idleExpiry
+			reason = fmt.Sprintf("no new commits were pushed for the idle timeout of %s", spec.IdleTimeout.Duration)
+		}
+	}
+	return expiresAt, reason
+}
+
+// Returns the time at which the environment of a PR which is no longer open is deleted, based on the teardown policy
+// for the outcome of the PR and the deletion grace period. nil is returned if the environment is retained indefinitely
+func getPREnvDeletionTime(spec prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus) *metav1.Time {
+	if envStatus.ClosedAt == nil {
+		return nil
+	}
+	delay := spec.DeletionGracePeriod
+	if policy := getTeardownPolicy(spec, envStatus.Outcome); policy.Action == prcontrollerephemeralenviov1alpha1.TeardownActionRetain {
+		if policy.RetainFor == nil {
+			return nil
+		}
+		delay = policy.RetainFor
+	}
+	deleteAt := *envStatus.ClosedAt
+	if delay != nil {
+		deleteAt = metav1.NewTime(deleteAt.Add(delay.Duration))
+	}
+	return &deleteAt
+}
+
+// Returns the duration until the next environment of the controller expires, or is deleted after its PR was closed.
+// 0 is returned if no environment expires
+func getNextPREnvExpiry(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) time.Duration {
+	var next time.Duration
+	for i := range prController.Status.Environments {
+		envStatus := &prController.Status.Environments[i]
+		expiresAt := envStatus.ExpiresAt
+		if envStatus.ClosedAt != nil {
+			expiresAt = getPREnvDeletionTime(prController.Spec, envStatus)
+		}
+		if expiresAt == nil || envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseExpired {
+			continue
+		}
+		untilExpiry := expiresAt.Sub(now.Time)
+		if untilExpiry > 0 && (next == 0 || untilExpiry < next) {
+			next = untilExpiry
+		}
+	}
+	return next
+}
+
+// Deletes the Flux HelmRelease of a PR whose environment expired, and updates the PR status on Github explaining
+// why the environment was removed. The environment is recreated when a new commit is pushed to the PR.
+func (r *PREphemeralEnvControllerReconciler) ExpireFluxHelmRelease(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, reason string, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	logger := log.FromContext(ctx)
+
+	deleteCtx, span := r.startSpan(ctx, "DeleteFluxHelmRelease", withPRAttributes(prDetails.Number, prDetails.HeadSHA))
+	err := client.IgnoreNotFound(r.Client.Delete(deleteCtx, &helmRel))
+	endSpan(span, err)
+	recordEnvOperation(prController, ENV_OPERATION_DELETE, err)
+	if err != nil {
+		mesg := fmt.Sprintf("unable to delete expired flux HelmRelease for prNumber: %d", prDetails.Number)
+		r.Record.Event(prController, "Warning", "DeleteFailed", mesg)
+		logger.Error(err, mesg)
+		return err
+	}
+
+	envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseExpired
+	envStatus.HeadSHA = prDetails.HeadSHA
+	envStatus.Message = fmt.Sprintf("Ephemeral environment removed as %s", reason)
+
+	mesg := fmt.Sprintf("Expired flux HelmRelease deleted for PR %d, %s", prDetails.Number, reason)
+	r.Record.Event(prController, "Normal", "EnvExpired", mesg)
+	logger.Info(mesg, "prNumber", prDetails.Number)
+
+	description := fmt.Sprintf("Environment removed as %s, push a new commit to recreate it", reason)
+	if err := r.UpdatePRStatus(ctx, prController, prDetails.Number, prDetails.HeadSHA, "error", description); err != nil {
+		logger.Error(err, "unable to update PR status")
+	}
+	return nil
+}
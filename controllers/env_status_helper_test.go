@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var envTestTime = time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// Returns a pointer to the time the number of hours passed after envTestTime
+func envTestTimeAfter(hours int) *metav1.Time {
+	t := metav1.NewTime(envTestTime.Add(time.Duration(hours) * time.Hour))
+	return &t
+}
+
+func hoursDuration(hours int) *metav1.Duration {
+	return &metav1.Duration{Duration: time.Duration(hours) * time.Hour}
+}
+
+func TestGetPREnvExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		ttl          *metav1.Duration
+		idleTimeout  *metav1.Duration
+		createdAt    *metav1.Time
+		lastCommitAt *metav1.Time
+		expected     *metav1.Time
+		reason       string
+	}{
+		{name: "no expiry", createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(0)},
+		{name: "ttl", ttl: hoursDuration(48), createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(10), expected: envTestTimeAfter(48), reason: "ttl"},
+		{name: "idle timeout", idleTimeout: hoursDuration(24), createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(10), expected: envTestTimeAfter(34), reason: "idle timeout"},
+		{name: "idle timeout first", ttl: hoursDuration(48), idleTimeout: hoursDuration(24), createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(10), expected: envTestTimeAfter(34), reason: "idle timeout"},
+		{name: "ttl first", ttl: hoursDuration(48), idleTimeout: hoursDuration(24), createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(30), expected: envTestTimeAfter(48), reason: "ttl"},
+		{name: "zero durations are ignored", ttl: hoursDuration(0), idleTimeout: hoursDuration(0), createdAt: envTestTimeAfter(0), lastCommitAt: envTestTimeAfter(0)},
+		{name: "no creation time", ttl: hoursDuration(48)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{TTL: tc.ttl, IdleTimeout: tc.idleTimeout}
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{CreatedAt: tc.createdAt, LastCommitAt: tc.lastCommitAt}
+			expiresAt, reason := getPREnvExpiry(spec, envStatus)
+			if (expiresAt == nil) != (tc.expected == nil) || (expiresAt != nil && !expiresAt.Equal(tc.expected)) {
+				t.Errorf("expected expiry at %v, got %v", tc.expected, expiresAt)
+			}
+			if !strings.Contains(reason, tc.reason) {
+				t.Errorf("expected the reason to mention the %s, got %q", tc.reason, reason)
+			}
+		})
+	}
+}
+
+func TestGetNextPREnvExpiry(t *testing.T) {
+	now := *envTestTimeAfter(0)
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{}
+	prController.Status.Environments = []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{
+		{PRNumber: 1, ExpiresAt: envTestTimeAfter(5)},
+		{PRNumber: 2, ExpiresAt: envTestTimeAfter(2)},
+		{PRNumber: 3, ExpiresAt: envTestTimeAfter(1), Phase: prcontrollerephemeralenviov1alpha1.EnvPhaseExpired},
+		{PRNumber: 4, ExpiresAt: envTestTimeAfter(-1)},
+		{PRNumber: 5},
+	}
+	if next := getNextPREnvExpiry(prController, now); next != 2*time.Hour {
+		t.Errorf("expected the next expiry in 2h, got %s", next)
+	}
+}
+
+func TestGetPREnvDeletionTime(t *testing.T) {
+	retain := &prcontrollerephemeralenviov1alpha1.TeardownPolicy{Action: prcontrollerephemeralenviov1alpha1.TeardownActionRetain}
+	retainFor := &prcontrollerephemeralenviov1alpha1.TeardownPolicy{Action: prcontrollerephemeralenviov1alpha1.TeardownActionRetain, RetainFor: hoursDuration(72)}
+	snapshot := &prcontrollerephemeralenviov1alpha1.TeardownPolicy{Action: prcontrollerephemeralenviov1alpha1.TeardownActionSnapshotThenDelete}
+	for _, tc := range []struct {
+		name        string
+		gracePeriod *metav1.Duration
+		onMerged    *prcontrollerephemeralenviov1alpha1.TeardownPolicy
+		onClosed    *prcontrollerephemeralenviov1alpha1.TeardownPolicy
+		outcome     string
+		closedAt    *metav1.Time
+		expected    *metav1.Time
+	}{
+		{name: "PR still open", gracePeriod: hoursDuration(1)},
+		{name: "deleted when closed", outcome: prcontrollerephemeralenviov1alpha1.PROutcomeClosed, closedAt: envTestTimeAfter(0), expected: envTestTimeAfter(0)},
+		{name: "grace period", gracePeriod: hoursDuration(2), outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, closedAt: envTestTimeAfter(0), expected: envTestTimeAfter(2)},
+		{name: "grace period before the snapshot", gracePeriod: hoursDuration(2), onMerged: snapshot, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, closedAt: envTestTimeAfter(0), expected: envTestTimeAfter(2)},
+		{name: "retained indefinitely", gracePeriod: hoursDuration(2), onClosed: retain, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeClosed, closedAt: envTestTimeAfter(0)},
+		{name: "retained for a duration", gracePeriod: hoursDuration(2), onClosed: retainFor, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeClosed, closedAt: envTestTimeAfter(0), expected: envTestTimeAfter(72)},
+		{name: "policy of the other outcome", gracePeriod: hoursDuration(2), onClosed: retain, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, closedAt: envTestTimeAfter(0), expected: envTestTimeAfter(2)},
+		{name: "merged retained", onMerged: retainFor, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, closedAt: envTestTimeAfter(1), expected: envTestTimeAfter(73)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{DeletionGracePeriod: tc.gracePeriod, OnMerged: tc.onMerged, OnClosed: tc.onClosed}
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{Outcome: tc.outcome, ClosedAt: tc.closedAt}
+			deleteAt := getPREnvDeletionTime(spec, envStatus)
+			if (deleteAt == nil) != (tc.expected == nil) || (deleteAt != nil && !deleteAt.Equal(tc.expected)) {
+				t.Errorf("expected deletion at %v, got %v", tc.expected, deleteAt)
+			}
+		})
+	}
+}
+
+func TestRecordPRStatus(t *testing.T) {
+	envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{PRNumber: 7}
+	recordPRStatus(envStatus, "", "c0ffee", "pending", "Deploying environment")
+	recordPRStatus(envStatus, "pr-ephemeral-env/api", "c0ffee", "success", "Health check api passed")
+	recordPRStatus(envStatus, "", "c0ffee", "success", "Environment is ready")
+
+	for _, tc := range []struct {
+		name          string
+		statusContext string
+		sha           string
+		state         string
+		description   string
+		expected      bool
+	}{
+		{name: "last status of the default context", sha: "c0ffee", state: "success", description: "Environment is ready", expected: true},
+		{name: "replaced status", sha: "c0ffee", state: "pending", description: "Deploying environment"},
+		{name: "other description", sha: "c0ffee", state: "success", description: "Environment is ready for PR 7"},
+		{name: "new commit", sha: "decaf0", state: "success", description: "Environment is ready"},
+		{name: "health check context", statusContext: "pr-ephemeral-env/api", sha: "c0ffee", state: "success", description: "Health check api passed", expected: true},
+		{name: "context never reported", statusContext: "pr-ephemeral-env/web", sha: "c0ffee", state: "success", description: "Health check web passed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if reported := isPRStatusReported(envStatus, tc.statusContext, tc.sha, tc.state, tc.description); reported != tc.expected {
+				t.Errorf("expected reported %v, got %v", tc.expected, reported)
+			}
+		})
+	}
+	if len(envStatus.ReportedStatuses) != 2 {
+		t.Errorf("expected one reported status per context, got %+v", envStatus.ReportedStatuses)
+	}
+}
+
+func TestUpdatePRStatusSkipsReportedStatus(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{}
+	envStatus := getPREnvStatus(prController, 7)
+	description := strings.Repeat("Environment is not ready: ", 10)
+	recordPRStatus(envStatus, "", "c0ffee", "failure", description[:GH_STATUS_DESCRIPTION_MAX_LENGTH])
+
+	// Github is not called, the reconciler has no token to create a client with
+	r := &PREphemeralEnvControllerReconciler{}
+	if err := r.UpdatePRStatus(context.Background(), prController, 7, "c0ffee", "failure", description); err != nil {
+		t.Errorf("expected the status reported before to be skipped, got %v", err)
+	}
+}
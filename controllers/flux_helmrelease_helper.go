@@ -1,14 +1,21 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 
 	"time"
 
 	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	fluxmeta "github.com/fluxcd/pkg/apis/meta"
 	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
-	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -18,36 +25,253 @@ const (
 	FLUX_POLL_INTERVAL          = 5 * time.Minute
 	FLUX_SOURCE_KIND            = "GitRepository"
 	FLUX_SOURCE_REPO_NAME_SPACE = "flux-system"
+	SPEC_HASH_ANNOTATION        = "prephemeralenv.io/spec-hash"
+	FREEZE_ANNOTATION           = "prephemeralenv.io/freeze"
 )
 
-// Creates a Flux HelmRelease for the PR, the resource is created in the namespace specified in the CRD
-func (r *PREphemeralEnvControllerReconciler) CreateFluxHelmRelease(ctx context.Context, prDetails PRDetails) error {
+// Converts the valuesFrom references in the CRD to Flux HelmRelease values references
+func getFluxValuesReferences(refs []prcontrollerephemeralenviov1alpha1.ValuesReference) []fluxhelmrelease.ValuesReference {
+	var fluxRefs []fluxhelmrelease.ValuesReference
+	for _, ref := range refs {
+		fluxRefs = append(fluxRefs, fluxhelmrelease.ValuesReference{
+			Kind:       ref.Kind,
+			Name:       ref.Name,
+			ValuesKey:  ref.ValuesKey,
+			TargetPath: ref.TargetPath,
+			Optional:   ref.Optional,
+		})
+	}
+	return fluxRefs
+}
+
+// Builds the Flux HelmRelease spec for the PR, targeting the namespace passed if not empty. The helmReleaseTemplate from the CRD, if any, is deep merged into the
+// generated spec, an error is returned if the template conflicts with the generated spec.
+func getFluxHelmReleaseSpec(helmRepo prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo, prDetails PRDetails, targetNamespace string) (fluxhelmrelease.HelmReleaseSpec, error) {
+	values, err := buildHelmReleaseValues(helmRepo, prDetails)
+	if err != nil {
+		return fluxhelmrelease.HelmReleaseSpec{}, err
+	}
 
-	prNumberStr := fmt.Sprintf("%d", prDetails.Number)
 	releaseName := fmt.Sprintf("%s%d", FLUX_HELM_RELEASE_PREFIX, prDetails.Number)
-	helmRelease := &fluxhelmrelease.HelmRelease{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      releaseName,
-			Namespace: r.EnvCreationHelmRepo.DestinationNamespace,
-		},
-		Spec: fluxhelmrelease.HelmReleaseSpec{
-			Chart: fluxhelmrelease.HelmChartTemplate{
-				Spec: fluxhelmrelease.HelmChartTemplateSpec{
-					Chart: r.EnvCreationHelmRepo.HelmChartPath,
-					SourceRef: fluxhelmrelease.CrossNamespaceObjectReference{
-						Kind:      FLUX_SOURCE_KIND,
-						Name:      r.EnvCreationHelmRepo.FluxSourceRepoName,
-						Namespace: FLUX_SOURCE_REPO_NAME_SPACE,
-					},
-					Version: r.EnvCreationHelmRepo.ChartVersion,
+	spec := fluxhelmrelease.HelmReleaseSpec{
+		Chart: fluxhelmrelease.HelmChartTemplate{
+			Spec: fluxhelmrelease.HelmChartTemplateSpec{
+				Chart: helmRepo.HelmChartPath,
+				SourceRef: fluxhelmrelease.CrossNamespaceObjectReference{
+					Kind:      FLUX_SOURCE_KIND,
+					Name:      helmRepo.FluxSourceRepoName,
+					Namespace: FLUX_SOURCE_REPO_NAME_SPACE,
 				},
+				Version: helmRepo.ChartVersion,
 			},
-			Values: &apiextensionsv1.JSON{
-				Raw: []byte(`{"prNumber":` + prNumberStr + `, "prSHA":"` + prDetails.HeadSHA + `"}`),
-			},
-			Interval:    metav1.Duration{Duration: FLUX_POLL_INTERVAL},
-			ReleaseName: releaseName,
 		},
+		Values:          values,
+		ValuesFrom:      getFluxValuesReferences(helmRepo.ValuesFrom),
+		ReleaseName:     releaseName,
+		TargetNamespace: targetNamespace,
+	}
+
+	if helmRepo.HelmReleaseTemplate != nil && len(helmRepo.HelmReleaseTemplate.Raw) > 0 {
+		if spec, err = applyHelmReleaseTemplate(spec, helmRepo.HelmReleaseTemplate.Raw); err != nil {
+			return fluxhelmrelease.HelmReleaseSpec{}, err
+		}
+	}
+
+	// The poll interval is only a default, and can be overridden by the template
+	if spec.Interval.Duration == 0 {
+		spec.Interval = metav1.Duration{Duration: FLUX_POLL_INTERVAL}
+	}
+
+	return spec, nil
+}
+
+// Deep merges the helmReleaseTemplate into the generated HelmRelease spec. Fields which are set both by the
+// controller and the template, with different values, are reported as conflicts.
+func applyHelmReleaseTemplate(spec fluxhelmrelease.HelmReleaseSpec, helmReleaseTemplate []byte) (fluxhelmrelease.HelmReleaseSpec, error) {
+	tmpl := map[string]interface{}{}
+
+	generated, err := specToMap(spec)
+	if err != nil {
+		return spec, err
+	}
+	// The interval is not set yet at this point, and is always serialized
+	if spec.Interval.Duration == 0 {
+		delete(generated, "interval")
+	}
+	if err := json.Unmarshal(helmReleaseTemplate, &tmpl); err != nil {
+		return spec, fmt.Errorf("helmReleaseTemplate is not a valid object: %w", err)
+	}
+
+	var conflicts []string
+	mergeHelmReleaseTemplate(generated, tmpl, "spec", &conflicts)
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return spec, fmt.Errorf("helmReleaseTemplate conflicts with the generated HelmRelease spec at %s", strings.Join(conflicts, ", "))
+	}
+
+	raw, err := json.Marshal(generated)
+	if err != nil {
+		return spec, err
+	}
+	merged := fluxhelmrelease.HelmReleaseSpec{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&merged); err != nil {
+		return spec, fmt.Errorf("helmReleaseTemplate is not a valid HelmRelease spec: %w", err)
+	}
+	return merged, nil
+}
+
+func mergeHelmReleaseTemplate(dst, src map[string]interface{}, path string, conflicts *[]string) {
+	for key, srcVal := range src {
+		fieldPath := path + "." + key
+		dstVal, exists := dst[key]
+		if !exists {
+			dst[key] = srcVal
+			continue
+		}
+		srcMap, srcIsMap := srcVal.(map[string]interface{})
+		dstMap, dstIsMap := dstVal.(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeHelmReleaseTemplate(dstMap, srcMap, fieldPath, conflicts)
+			continue
+		}
+		if !reflect.DeepEqual(srcVal, dstVal) {
+			*conflicts = append(*conflicts, fieldPath)
+		}
+	}
+}
+
+// Returns a hash of the HelmRelease spec generated by the controller, which is stored as an annotation on the HelmRelease
+func getSpecHash(spec fluxhelmrelease.HelmReleaseSpec) (string, error) {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(raw)), nil
+}
+
+// Checks if the HelmRelease matches the spec generated by the controller. The HelmRelease is out of date if the spec
+// it was generated from has changed, or if any field set by the controller has been changed on the HelmRelease.
+// Fields defaulted by the API server are ignored.
+func isHelmReleaseUpToDate(helmRel fluxhelmrelease.HelmRelease, desiredSpec fluxhelmrelease.HelmReleaseSpec) (bool, error) {
+	specHash, err := getSpecHash(desiredSpec)
+	if err != nil {
+		return false, err
+	}
+	if helmRel.Annotations[SPEC_HASH_ANNOTATION] != specHash {
+		return false, nil
+	}
+
+	desired, err := specToMap(desiredSpec)
+	if err != nil {
+		return false, err
+	}
+	actual, err := specToMap(helmRel.Spec)
+	if err != nil {
+		return false, err
+	}
+	return isSubset(desired, actual), nil
+}
+
+func specToMap(spec fluxhelmrelease.HelmReleaseSpec) (map[string]interface{}, error) {
+	specMap := map[string]interface{}{}
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &specMap); err != nil {
+		return nil, err
+	}
+	return specMap, nil
+}
+
+// Checks if all fields set in desired have the same value in actual
+func isSubset(desired, actual interface{}) bool {
+	switch desiredVal := desired.(type) {
+	case map[string]interface{}:
+		actualMap, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, val := range desiredVal {
+			if !isSubset(val, actualMap[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actualSlice, ok := actual.([]interface{})
+		if !ok || len(actualSlice) != len(desiredVal) {
+			return false
+		}
+		for i := range desiredVal {
+			if !isSubset(desiredVal[i], actualSlice[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(desired, actual)
+	}
+}
+
+// Checks if Flux is still installing or upgrading the HelmRelease
+func isHelmReleaseInProgress(helmRel fluxhelmrelease.HelmRelease) bool {
+	if helmRel.Generation != helmRel.Status.ObservedGeneration {
+		return true
+	}
+	readyCondition := apimeta.FindStatusCondition(helmRel.Status.Conditions, fluxmeta.ReadyCondition)
+	return readyCondition == nil || readyCondition.Status == metav1.ConditionUnknown
+}
+
+// Checks if Flux has successfully installed or upgraded the current generation of the HelmRelease
+func isHelmReleaseReady(helmRel fluxhelmrelease.HelmRelease) bool {
+	if helmRel.Generation != helmRel.Status.ObservedGeneration {
+		return false
+	}
+	return apimeta.IsStatusConditionTrue(helmRel.Status.Conditions, fluxmeta.ReadyCondition)
+}
+
+// Checks if the HelmRelease has the freeze annotation set to "true", in which case the controller leaves the
+// environment of the PR untouched
+func isHelmReleaseFrozen(helmRel fluxhelmrelease.HelmRelease) bool {
+	return helmRel.Annotations[FREEZE_ANNOTATION] == "true"
+}
+
+// Validates that the helmReleaseTemplate in the CRD can be merged into the generated HelmRelease spec
+func ValidateHelmReleaseTemplate(helmRepo prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo) error {
+	if helmRepo.HelmReleaseTemplate == nil || len(helmRepo.HelmReleaseTemplate.Raw) == 0 {
+		return nil
+	}
+	_, err := getFluxHelmReleaseSpec(helmRepo, PRDetails{}, "")
+	return err
+}
+
+// Creates a Flux HelmRelease for the PR, the resource is created in the namespace specified in the CRD
+func (r *PREphemeralEnvControllerReconciler) CreateFluxHelmRelease(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prDetails PRDetails, targetNamespace string) (err error) {
+	ctx, span := r.startSpan(ctx, "CreateFluxHelmRelease", withPRAttributes(prDetails.Number, prDetails.HeadSHA))
+	defer func() { endSpan(span, err) }()
+	helmRepo := *prController.Spec.EnvCreationHelmRepo
+
+	spec, err := getFluxHelmReleaseSpec(helmRepo, prDetails, targetNamespace)
+	if err != nil {
+		return err
+	}
+
+	specHash, err := getSpecHash(spec)
+	if err != nil {
+		return err
+	}
+
+	helmRelease := &fluxhelmrelease.HelmRelease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        spec.ReleaseName,
+			Namespace:   helmRepo.DestinationNamespace,
+			Labels:      getPRLabels(prController, prDetails.Number),
+			Annotations: map[string]string{SPEC_HASH_ANNOTATION: specHash},
+		},
+		Spec: spec,
 	}
 
 	if err := r.Create(ctx, helmRelease); err != nil {
@@ -56,12 +280,37 @@ func (r *PREphemeralEnvControllerReconciler) CreateFluxHelmRelease(ctx context.C
 	return nil
 }
 
-// Updates a Flux HelmRelease for the PR, this is called when new commit is pushed to the PR. The Flux Helm release is updated and results in
-// the commit SHA being updated in the HelmRelease values.
-func (r *PREphemeralEnvControllerReconciler) UpdateFluxHelmRelease(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetail PRDetails) error {
+// Checks if the Flux HelmRelease of the PR matches the spec generated from the CRD and the PR
+func (r *PREphemeralEnvControllerReconciler) IsFluxHelmReleaseUpToDate(helmRepo prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo, helmRel fluxhelmrelease.HelmRelease, prDetail PRDetails, targetNamespace string) (bool, error) {
+	spec, err := getFluxHelmReleaseSpec(helmRepo, prDetail, targetNamespace)
+	if err != nil {
+		return false, err
+	}
+	return isHelmReleaseUpToDate(helmRel, spec)
+}
+
+// Updates a Flux HelmRelease for the PR, this is called when new commit is pushed to the PR, or when the spec generated from the CRD changes.
+// The Flux Helm release is updated and results in the commit SHA and any other changes being rolled out.
+func (r *PREphemeralEnvControllerReconciler) UpdateFluxHelmRelease(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, helmRel fluxhelmrelease.HelmRelease, prDetail PRDetails, targetNamespace string) (err error) {
+	ctx, span := r.startSpan(ctx, "UpdateFluxHelmRelease", withPRAttributes(prDetail.Number, prDetail.HeadSHA))
+	defer func() { endSpan(span, err) }()
 	logger := log.FromContext(ctx)
 	logger.Info("updating helm release...")
-	helmRel.Spec.Values.Raw = []byte(fmt.Sprintf(`{"prNumber": %d, "prSHA": "%s"}`, prDetail.Number, prDetail.HeadSHA))
+	spec, err := getFluxHelmReleaseSpec(*prController.Spec.EnvCreationHelmRepo, prDetail, targetNamespace)
+	if err != nil {
+		logger.Error(err, "unable to build HelmRelease spec")
+		return err
+	}
+	specHash, err := getSpecHash(spec)
+	if err != nil {
+		return err
+	}
+	helmRel.Spec = spec
+	if helmRel.Annotations == nil {
+		helmRel.Annotations = map[string]string{}
+	}
+	helmRel.Annotations[SPEC_HASH_ANNOTATION] = specHash
+	helmRel.Labels = mergeLabels(helmRel.Labels, getPRLabels(prController, prDetail.Number))
 	if err := r.Client.Update(ctx, &helmRel); err != nil {
 		logger.Error(err, "unable to update HelmRelease")
 		return err
@@ -70,27 +319,130 @@ func (r *PREphemeralEnvControllerReconciler) UpdateFluxHelmRelease(ctx context.C
 	return nil
 }
 
-// The function deletes FLUX HelmReleases for which PRs are no longer open. It is passed a list of Flux
-func (r *PREphemeralEnvControllerReconciler) DeleteFluxHelmRelease(ctx context.Context, helmReleases map[int]fluxhelmrelease.HelmRelease, prDetails map[int]PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+// The function deletes FLUX HelmReleases for which PRs are no longer open. PRs which are no longer open are looked up
+// on Github to find out if they were merged or closed, and the teardown policy for that outcome is applied. The HelmRelease
+// is deleted once the deletion grace period (or retention duration) has passed, and any volume snapshots are ready.
+func (r *PREphemeralEnvControllerReconciler) DeleteFluxHelmRelease(ctx context.Context, helmReleases map[int]fluxhelmrelease.HelmRelease, prDetails map[int]PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) error {
 	logger := log.FromContext(ctx)
 	logger.Info("Checking if any flux helm releases need to be deleted...")
 	for prNumber, helmRel := range helmReleases {
-		if prDet, ok := prDetails[prNumber]; !ok {
-			// Update status of PR on Github
-			r.UpdatePRStatus(ctx, prNumber, prDet.HeadSHA, "closed", "PR closed, deleting ephemeral environment")
-			mesg := fmt.Sprintf("Deletion request submitted for flux HelmRelease of prNumber: %d", prNumber)
-			r.Record.Event(prController, "Normal", "DelReqSubmitted", mesg)
+		if isHelmReleaseFrozen(helmRel) {
+			logger.Info("Flux HelmRelease is frozen, skipping deletion", "prNumber", prNumber)
+			continue
+		}
+		if _, ok := prDetails[prNumber]; ok {
+			continue
+		}
+		// Flux is already uninstalling the release
+		if !helmRel.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		envStatus := getPREnvStatus(prController, prNumber)
+		prDet, _ := getPRDetailsForHelmRelease(ctx, helmRel)
+		var closedPR *PRDetails
+		if envStatus.ClosedAt == nil {
+			pr, err := r.GetPullRequest(ctx, prNumber)
+			if err != nil {
+				envStatus.Message = "Unable to look up closed PR on Github"
+				logger.Error(err, "unable to get closed PR", "prNumber", prNumber)
+				continue
+			}
+			closedPR = &pr
+			closedAt := now
+			if !closedPR.ClosedAt.IsZero() {
+				closedAt = metav1.NewTime(closedPR.ClosedAt)
+			}
+			envStatus.ClosedAt = &closedAt
+			envStatus.Outcome = prcontrollerephemeralenviov1alpha1.PROutcomeClosed
+			if closedPR.Merged {
+				envStatus.Outcome = prcontrollerephemeralenviov1alpha1.PROutcomeMerged
+				envStatus.MergeCommitSHA = closedPR.MergeCommitSHA
+			}
+
+			mesg := fmt.Sprintf("PR %d %s, applying the %s teardown policy", prNumber, strings.ToLower(envStatus.Outcome), getTeardownPolicy(prController.Spec, envStatus.Outcome).Action)
+			r.Record.Event(prController, "Normal", "PR"+envStatus.Outcome, mesg)
 			logger.Info(mesg, "prNumber", prNumber)
-			if err := r.Client.Delete(ctx, &helmRel); err != nil {
-				mesg := fmt.Sprintf("unable to delete flux HelmRelease for prNumber: %d", prNumber)
-				r.Record.Event(prController, "Warning", "DeleteFailed", mesg)
+
+			// Update status of PR on Github
+			description := fmt.Sprintf("PR %s, ephemeral environment is deleted", strings.ToLower(envStatus.Outcome))
+			if deleteAt := getPREnvDeletionTime(prController.Spec, envStatus); deleteAt == nil {
+				description = fmt.Sprintf("PR %s, ephemeral environment is retained", strings.ToLower(envStatus.Outcome))
+			} else if deleteAt.After(now.Time) {
+				description = fmt.Sprintf("PR %s, ephemeral environment is deleted at %s", strings.ToLower(envStatus.Outcome), deleteAt.UTC().Format(time.RFC3339))
+			}
+			// Github only accepts the error, failure, pending and success states
+			if err := r.UpdatePRStatus(ctx, prController, prNumber, closedPR.HeadSHA, "success", description); err != nil {
+				logger.Error(err, "unable to update PR status", "prNumber", prNumber)
+			}
+		}
+
+		policy := getTeardownPolicy(prController.Spec, envStatus.Outcome)
+		deleteAt := getPREnvDeletionTime(prController.Spec, envStatus)
+		if deleteAt == nil {
+			envStatus.Message = fmt.Sprintf("PR %s, environment is retained", strings.ToLower(envStatus.Outcome))
+			continue
+		}
+		if now.Before(deleteAt) {
+			envStatus.Message = fmt.Sprintf("PR %s, environment is deleted at %s", strings.ToLower(envStatus.Outcome), deleteAt.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		// Flux does not uninstall suspended HelmReleases, hibernated environments are resumed before they are deleted
+		if resumed, err := r.ResumeHibernatedHelmRelease(ctx, helmRel, envStatus); err != nil || !resumed {
+			if err != nil {
+				logger.Error(err, "unable to resume hibernated environment before deleting it", "prNumber", prNumber)
+			}
+			continue
+		}
+
+		// Run the preDelete hook with the metadata of the closed PR, falling back to the PR details of the HelmRelease.
+		// The closed PR is only looked up again if it was not fetched by this reconcile
+		if prController.Spec.Hooks != nil && prController.Spec.Hooks.PreDelete != nil && envStatus.PreDeleteHook == "" {
+			if closedPR == nil {
+				if pr, err := r.GetPullRequest(ctx, prNumber); err == nil {
+					closedPR = &pr
+				}
+			}
+			if closedPR != nil {
+				prDet = *closedPR
+			}
+		}
+		if !r.RunPreDeleteHook(ctx, helmRel, prDet, envStatus, prController, now) {
+			continue
+		}
+
+		if policy.Action == prcontrollerephemeralenviov1alpha1.TeardownActionSnapshotThenDelete {
+			ready, err := r.SnapshotPRVolumes(ctx, helmRel, prDet, *envStatus.ClosedAt, policy, prController)
+			if err != nil {
+				mesg := fmt.Sprintf("unable to snapshot volumes of environment for prNumber: %d", prNumber)
+				r.Record.Event(prController, "Warning", "SnapshotFailed", mesg)
 				logger.Error(err, mesg)
-				return err
+				continue
+			}
+			if !ready {
+				envStatus.Message = "Waiting for the volume snapshots of the environment to be ready before deleting it"
+				continue
 			}
+		}
+		envStatus.Message = fmt.Sprintf("PR %s, deleting environment", strings.ToLower(envStatus.Outcome))
 
-			mesg = fmt.Sprintf("Deletion request submitted for flux HelmRelease of prNumber: %d", prNumber)
-			logger.Info(mesg, "prNumber", prNumber)
+		mesg := fmt.Sprintf("Deletion request submitted for flux HelmRelease of prNumber: %d", prNumber)
+		r.Record.Event(prController, "Normal", "DelReqSubmitted", mesg)
+		logger.Info(mesg, "prNumber", prNumber)
+		deleteCtx, span := r.startSpan(ctx, "DeleteFluxHelmRelease", withPRAttributes(prNumber, envStatus.HeadSHA))
+		err := r.Client.Delete(deleteCtx, &helmRel)
+		endSpan(span, err)
+		recordEnvOperation(prController, ENV_OPERATION_DELETE, err)
+		if err != nil {
+			mesg := fmt.Sprintf("unable to delete flux HelmRelease for prNumber: %d", prNumber)
+			r.Record.Event(prController, "Warning", "DeleteFailed", mesg)
+			logger.Error(err, mesg)
+			return err
 		}
+
+		mesg = fmt.Sprintf("Deletion request submitted for flux HelmRelease of prNumber: %d", prNumber)
+		logger.Info(mesg, "prNumber", prNumber)
 	}
 
 	return nil
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeHelmReleaseTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		dst       map[string]interface{}
+		src       map[string]interface{}
+		expected  map[string]interface{}
+		conflicts []string
+	}{
+		{
+			name:     "new fields are added",
+			dst:      map[string]interface{}{"releaseName": "pr-1"},
+			src:      map[string]interface{}{"install": map[string]interface{}{"remediation": map[string]interface{}{"retries": 3}}},
+			expected: map[string]interface{}{"releaseName": "pr-1", "install": map[string]interface{}{"remediation": map[string]interface{}{"retries": 3}}},
+		},
+		{
+			name:     "same values do not conflict",
+			dst:      map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0"}}},
+			src:      map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0", "reconcileStrategy": "Revision"}}},
+			expected: map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0", "reconcileStrategy": "Revision"}}},
+		},
+		{
+			name:      "different values conflict",
+			dst:       map[string]interface{}{"releaseName": "pr-1", "chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0"}}},
+			src:       map[string]interface{}{"releaseName": "other", "chart": map[string]interface{}{"spec": map[string]interface{}{"version": "2.0.0"}}},
+			expected:  map[string]interface{}{"releaseName": "pr-1", "chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0"}}},
+			conflicts: []string{"spec.chart.spec.version", "spec.releaseName"},
+		},
+		{
+			name:      "a map conflicts with a scalar",
+			dst:       map[string]interface{}{"values": map[string]interface{}{"prNumber": 1}},
+			src:       map[string]interface{}{"values": "none"},
+			expected:  map[string]interface{}{"values": map[string]interface{}{"prNumber": 1}},
+			conflicts: []string{"spec.values"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var conflicts []string
+			mergeHelmReleaseTemplate(tc.dst, tc.src, "spec", &conflicts)
+			if !reflect.DeepEqual(tc.dst, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, tc.dst)
+			}
+			sort.Strings(conflicts)
+			if len(conflicts) != len(tc.conflicts) || (len(conflicts) > 0 && !reflect.DeepEqual(conflicts, tc.conflicts)) {
+				t.Errorf("expected conflicts %v, got %v", tc.conflicts, conflicts)
+			}
+		})
+	}
+}
+
+func TestGetFluxHelmReleaseSpecTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		errorAt  string
+	}{
+		{
+			name:     "template fields are merged",
+			template: `{"interval":"1m","install":{"remediation":{"retries":3}},"chart":{"spec":{"version":"1.0.0"}}}`,
+		},
+		{name: "conflicting chart version", template: `{"chart":{"spec":{"version":"2.0.0"}}}`, errorAt: "spec.chart.spec.version"},
+		{name: "not an object", template: `["a"]`, errorAt: "not a valid object"},
+		{name: "unknown field", template: `{"unknown":true}`, errorAt: "not a valid HelmRelease spec"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			helmRepo := prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+				FluxSourceRepoName:  "charts",
+				HelmChartPath:       "charts/app",
+				ChartVersion:        "1.0.0",
+				HelmReleaseTemplate: &apiextensionsv1.JSON{Raw: []byte(tc.template)},
+			}
+			spec, err := getFluxHelmReleaseSpec(helmRepo, testPRDetails, "")
+			if tc.errorAt != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errorAt) {
+					t.Fatalf("expected an error about %s, got %v", tc.errorAt, err)
+				}
+				if validateErr := ValidateHelmReleaseTemplate(helmRepo); validateErr == nil {
+					t.Error("expected the template to be rejected by ValidateHelmReleaseTemplate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec.Interval.Duration != time.Minute {
+				t.Errorf("expected the interval of the template, got %s", spec.Interval.Duration)
+			}
+			if spec.Install == nil || spec.Install.Remediation == nil || spec.Install.Remediation.Retries != 3 {
+				t.Errorf("expected the install remediation of the template, got %+v", spec.Install)
+			}
+			if spec.ReleaseName != FLUX_HELM_RELEASE_PREFIX+"42" || spec.Chart.Spec.Chart != "charts/app" {
+				t.Errorf("expected the generated fields to be kept, got release %s of chart %s", spec.ReleaseName, spec.Chart.Spec.Chart)
+			}
+		})
+	}
+}
+
+func TestIsSubset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		desired  interface{}
+		actual   interface{}
+		expected bool
+	}{
+		{name: "equal scalars", desired: "1.0.0", actual: "1.0.0", expected: true},
+		{name: "different scalars", desired: "1.0.0", actual: "2.0.0", expected: false},
+		{name: "scalar missing from actual", desired: "1.0.0", actual: nil, expected: false},
+		{
+			name:     "extra keys in actual are ignored",
+			desired:  map[string]interface{}{"releaseName": "pr-1"},
+			actual:   map[string]interface{}{"releaseName": "pr-1", "maxHistory": float64(10)},
+			expected: true,
+		},
+		{
+			name:     "key missing from actual",
+			desired:  map[string]interface{}{"releaseName": "pr-1", "targetNamespace": "pr-1"},
+			actual:   map[string]interface{}{"releaseName": "pr-1"},
+			expected: false,
+		},
+		{
+			name:     "nested maps",
+			desired:  map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0"}}},
+			actual:   map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0", "reconcileStrategy": "ChartVersion"}}},
+			expected: true,
+		},
+		{
+			name:     "nested value changed",
+			desired:  map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "1.0.0"}}},
+			actual:   map[string]interface{}{"chart": map[string]interface{}{"spec": map[string]interface{}{"version": "2.0.0"}}},
+			expected: false,
+		},
+		{
+			name:     "slices of the same length",
+			desired:  []interface{}{map[string]interface{}{"kind": "Secret", "name": "db"}},
+			actual:   []interface{}{map[string]interface{}{"kind": "Secret", "name": "db", "optional": false}},
+			expected: true,
+		},
+		{
+			name:     "slices of different lengths",
+			desired:  []interface{}{"a"},
+			actual:   []interface{}{"a", "b"},
+			expected: false,
+		},
+		{
+			name:     "slices in a different order",
+			desired:  []interface{}{"a", "b"},
+			actual:   []interface{}{"b", "a"},
+			expected: false,
+		},
+		{name: "map against a scalar", desired: map[string]interface{}{"a": "b"}, actual: "a", expected: false},
+		{name: "slice against a map", desired: []interface{}{"a"}, actual: map[string]interface{}{"0": "a"}, expected: false},
+		{name: "number against a string", desired: float64(1), actual: "1", expected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if subset := isSubset(tc.desired, tc.actual); subset != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, subset)
+			}
+		})
+	}
+}
+
+func TestGetSpecHash(t *testing.T) {
+	helmRepo := prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+		FluxSourceRepoName: "charts",
+		HelmChartPath:      "charts/app",
+		ChartVersion:       "1.0.0",
+	}
+	spec, err := getFluxHelmReleaseSpec(helmRepo, testPRDetails, "pr-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSpec, err := getFluxHelmReleaseSpec(helmRepo, testPRDetails, "pr-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	helmRepo.ChartVersion = "1.1.0"
+	bumpedSpec, err := getFluxHelmReleaseSpec(helmRepo, testPRDetails, "pr-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := getSpecHash(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameHash, err := getSpecHash(sameSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bumpedHash, err := getSpecHash(bumpedSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != sameHash {
+		t.Errorf("expected the same hash for equal specs, got %s and %s", hash, sameHash)
+	}
+	if hash == bumpedHash {
+		t.Errorf("expected a different hash after a chart version bump, got %s", hash)
+	}
+}
+
+func TestIsHelmReleaseUpToDate(t *testing.T) {
+	helmRepo := prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+		FluxSourceRepoName: "charts",
+		HelmChartPath:      "charts/app",
+		ChartVersion:       "1.0.0",
+	}
+	desiredSpec, err := getFluxHelmReleaseSpec(helmRepo, testPRDetails, "pr-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specHash, err := getSpecHash(desiredSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxHistory := 10
+
+	for _, tc := range []struct {
+		name     string
+		hash     string
+		mutate   func(spec *fluxhelmrelease.HelmReleaseSpec)
+		expected bool
+	}{
+		{name: "generated from the same spec", hash: specHash, expected: true},
+		{name: "no spec hash annotation", hash: "", expected: false},
+		{name: "generated from another spec", hash: "0123", expected: false},
+		{
+			name: "fields defaulted by Flux",
+			hash: specHash,
+			mutate: func(spec *fluxhelmrelease.HelmReleaseSpec) {
+				spec.Chart.Spec.ReconcileStrategy = "ChartVersion"
+				spec.Chart.Spec.Interval = &metav1.Duration{Duration: time.Minute}
+				spec.MaxHistory = &maxHistory
+				spec.Install = &fluxhelmrelease.Install{Timeout: &metav1.Duration{Duration: 5 * time.Minute}}
+			},
+			expected: true,
+		},
+		{
+			name:     "chart version changed by hand",
+			hash:     specHash,
+			mutate:   func(spec *fluxhelmrelease.HelmReleaseSpec) { spec.Chart.Spec.Version = "0.9.0" },
+			expected: false,
+		},
+		{
+			name:     "target namespace changed by hand",
+			hash:     specHash,
+			mutate:   func(spec *fluxhelmrelease.HelmReleaseSpec) { spec.TargetNamespace = "default" },
+			expected: false,
+		},
+		{
+			name:     "poll interval changed by hand",
+			hash:     specHash,
+			mutate:   func(spec *fluxhelmrelease.HelmReleaseSpec) { spec.Interval = metav1.Duration{Duration: time.Hour} },
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			helmRel := fluxhelmrelease.HelmRelease{Spec: *desiredSpec.DeepCopy()}
+			if tc.hash != "" {
+				helmRel.Annotations = map[string]string{SPEC_HASH_ANNOTATION: tc.hash}
+			}
+			if tc.mutate != nil {
+				tc.mutate(&helmRel.Spec)
+			}
+			upToDate, err := isHelmReleaseUpToDate(helmRel, desiredSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upToDate != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, upToDate)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"golang.org/x/oauth2"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Remaining Github API requests below which the controller stops calling Github until the rate limit resets
+	GH_RATE_LIMIT_MIN_REMAINING = 100
+	// Back off used when Github rejects a request for exceeding the secondary rate limit without a Retry-After
+	GH_ABUSE_RATE_LIMIT_BACKOFF = time.Minute
+	GH_ETAG_CACHE_MAX_ENTRIES   = 1000
+	GH_RATE_LIMIT_HEADER        = "X-RateLimit-Limit"
+	GH_RATE_REMAINING_HEADER    = "X-RateLimit-Remaining"
+	GH_RATE_RESET_HEADER        = "X-RateLimit-Reset"
+)
+
+// The Github clients and the HTTP cache shared by all reconciles
+var ghClients = newGHClientCache(http.DefaultTransport)
+
+type ghClientCache struct {
+	mu        sync.Mutex
+	clients   map[string]*ghClientEntry
+	transport *ghETagTransport
+}
+
+type ghClientEntry struct {
+	token  string
+	client *github.Client
+	rate   *ghRateTransport
+}
+
+// Creates a cache of Github clients sending their requests through the base transport passed
+func newGHClientCache(base http.RoundTripper) *ghClientCache {
+	return &ghClientCache{
+		clients:   map[string]*ghClientEntry{},
+		transport: &ghETagTransport{base: base, entries: map[string]*ghETagEntry{}},
+	}
+}
+
+// Returns the Github client for the token read from the Secret passed, creating it the first time the token is used.
+// When the token of the Secret is rotated, the client of the previous token is replaced and its cached responses are
+// evicted
+func (c *ghClientCache) get(ghRepo GHRepo) *ghClientEntry {
+	key := ghRepo.TokenSecret
+	if key == "" {
+		key = ghRepo.Token
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.clients[key]; ok {
+		if entry.token == ghRepo.Token {
+			return entry
+		}
+		c.transport.evict(entry.token)
+	}
+	rate := &ghRateTransport{base: c.transport}
+	entry := &ghClientEntry{
+		token:  ghRepo.Token,
+		client: github.NewClient(&http.Client{Transport: newGHAuthTransport(ghRepo.Token, rate)}),
+		rate:   rate,
+	}
+	c.clients[key] = entry
+	return entry
+}
+
+// Returns the transport authenticating the requests with the token, before passing them to the base transport
+func newGHAuthTransport(ghToken string, base http.RoundTripper) http.RoundTripper {
+	return &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: ghToken}),
+		Base:   base,
+	}
+}
+
+// Returns the last Github API rate limit seen for the token, false is returned if no request was made with it yet
+func GetGHRateLimit(ghRepo GHRepo) (github.Rate, bool) {
+	return ghClients.get(ghRepo).rate.get()
+}
+
+// Returns true if the remaining Github API requests are below GH_RATE_LIMIT_MIN_REMAINING, and the rate limit
+// has not been reset yet
+func isGHRateLimitLow(rate github.Rate, now time.Time) bool {
+	return rate.Limit > 0 && rate.Remaining < GH_RATE_LIMIT_MIN_REMAINING && rate.Reset.After(now)
+}
+
+// Returns the time at which the rate limit reported by the error returned by Github resets, false is returned if the
+// error is not a rate limit error
+func getGHRateLimitReset(err error, now time.Time) (time.Time, bool) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return rateLimitErr.Rate.Reset.Time, true
+	}
+	var abuseRateLimitErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseRateLimitErr) {
+		if retryAfter := abuseRateLimitErr.GetRetryAfter(); retryAfter > 0 {
+			return now.Add(retryAfter), true
+		}
+		return now.Add(GH_ABUSE_RATE_LIMIT_BACKOFF), true
+	}
+	return time.Time{}, false
+}
+
+// Sets the RateLimited condition and requeues the controller once the Github API rate limit resets, without calling
+// Github in the meantime
+func (r *PREphemeralEnvControllerReconciler) BackOffRateLimited(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, reset time.Time, now time.Time) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	mesg := fmt.Sprintf("Github API rate limit is low, backing off until it resets at %s", reset.UTC().Format(time.RFC3339))
+	logger.Info(mesg)
+	apimeta.SetStatusCondition(&prController.Status.Conditions, metav1.Condition{
+		Type:               prcontrollerephemeralenviov1alpha1.RateLimitedCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: prController.Generation,
+		Reason:             "QuotaLow",
+		Message:            mesg,
+	})
+	prController.Status.Message = "RateLimited"
+	_ = r.Status().Update(ctx, prController)
+	r.Record.Event(prController, "Warning", "RateLimited", mesg)
+
+	requeueAfter := reset.Sub(now)
+	if requeueAfter < time.Second {
+		requeueAfter = time.Second
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// Clears the RateLimited condition once Github calls succeed again
+func clearRateLimited(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) {
+	apimeta.SetStatusCondition(&prController.Status.Conditions, metav1.Condition{
+		Type:               prcontrollerephemeralenviov1alpha1.RateLimitedCondition,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: prController.Generation,
+		Reason:             "QuotaAvailable",
+		Message:            "Github API rate limit is not exhausted",
+	})
+}
+
+// ghRateTransport records the rate limit returned by Github with each response
+type ghRateTransport struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	rate *github.Rate
+}
+
+func (t *ghRateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	limit, err := strconv.Atoi(resp.Header.Get(GH_RATE_LIMIT_HEADER))
+	if err != nil {
+		return resp, nil
+	}
+	remaining, _ := strconv.Atoi(resp.Header.Get(GH_RATE_REMAINING_HEADER))
+	reset, _ := strconv.ParseInt(resp.Header.Get(GH_RATE_RESET_HEADER), 10, 64)
+
+	t.mu.Lock()
+	t.rate = &github.Rate{Limit: limit, Remaining: remaining, Reset: github.Timestamp{Time: time.Unix(reset, 0)}}
+	t.mu.Unlock()
+	return resp, nil
+}
+
+func (t *ghRateTransport) get() (github.Rate, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rate == nil {
+		return github.Rate{}, false
+	}
+	return *t.rate, true
+}
+
+// ghETagTransport sends GET requests to Github with the ETag of the cached response as If-None-Match, and serves the
+// cached response when Github answers 304 Not Modified, which does not count against the rate limit. Responses are
+// cached by URL and Authorization header, so that clients of different tokens do not share responses
+type ghETagTransport struct {
+	base    http.RoundTripper
+	mu      sync.Mutex
+	entries map[string]*ghETagEntry
+}
+
+type ghETagEntry struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+func (t *ghETagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+	key := getGHETagKey(req.Header.Get("Authorization"), req.URL.String())
+
+	t.mu.Lock()
+	entry := t.entries[key]
+	t.mu.Unlock()
+
+	if entry != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		header := entry.header.Clone()
+		for _, name := range []string{GH_RATE_LIMIT_HEADER, GH_RATE_REMAINING_HEADER, GH_RATE_RESET_HEADER} {
+			if value := resp.Header.Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(entry.body)),
+			ContentLength: int64(len(entry.body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	if _, ok := t.entries[key]; !ok && len(t.entries) >= GH_ETAG_CACHE_MAX_ENTRIES {
+		// Evict an arbitrary entry to bound the size of the cache
+		for evicted := range t.entries {
+			delete(t.entries, evicted)
+			break
+		}
+	}
+	t.entries[key] = &ghETagEntry{etag: etag, header: resp.Header.Clone(), body: body}
+	t.mu.Unlock()
+	return resp, nil
+}
+
+// Returns the key of the cached response of the request, responses are cached per token
+func getGHETagKey(authorization string, url string) string {
+	return authorization + " " + url
+}
+
+// Evicts the responses cached for the token, once the token was rotated
+func (t *ghETagTransport) evict(ghToken string) {
+	prefix := getGHETagKey("Bearer "+ghToken, "")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key := range t.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.entries, key)
+		}
+	}
+}
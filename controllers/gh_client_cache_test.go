@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// etagServer answers GET requests with an ETag, and with 304 Not Modified when the ETag is sent back as If-None-Match
+type etagServer struct {
+	mu          sync.Mutex
+	remaining   int
+	ifNoneMatch []string
+	notModified int
+	rateHeaders bool
+}
+
+func (s *etagServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ifNoneMatch = append(s.ifNoneMatch, req.Header.Get("If-None-Match"))
+	if s.rateHeaders {
+		s.remaining--
+		w.Header().Set(GH_RATE_LIMIT_HEADER, "5000")
+		w.Header().Set(GH_RATE_REMAINING_HEADER, strconv.Itoa(s.remaining))
+		w.Header().Set(GH_RATE_RESET_HEADER, "1700000000")
+	}
+	etag := fmt.Sprintf("%q", req.URL.Path+req.Header.Get("Authorization"))
+	if req.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = io.WriteString(w, `{"path":"`+req.URL.Path+`"}`)
+}
+
+func doGet(t *testing.T, transport http.RoundTripper, url string, authorization string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestGHETagTransport(t *testing.T) {
+	server := &etagServer{remaining: 100, rateHeaders: true}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	transport := &ghETagTransport{base: http.DefaultTransport, entries: map[string]*ghETagEntry{}}
+
+	_, first := doGet(t, transport, ts.URL+"/repos/org/app/pulls", "Bearer a")
+	resp, second := doGet(t, transport, ts.URL+"/repos/org/app/pulls", "Bearer a")
+	if server.ifNoneMatch[1] == "" {
+		t.Error("expected the cached ETag to be sent as If-None-Match")
+	}
+	if server.notModified != 1 {
+		t.Fatalf("expected Github to answer 304 Not Modified once, got %d", server.notModified)
+	}
+	if resp.StatusCode != http.StatusOK || second != first {
+		t.Errorf("expected the 304 to be turned back into the cached 200, got %d with body %q", resp.StatusCode, second)
+	}
+	if remaining := resp.Header.Get(GH_RATE_REMAINING_HEADER); remaining != "98" {
+		t.Errorf("expected the rate limit headers of the 304 response, got remaining %q", remaining)
+	}
+
+	// Responses are not shared between tokens, and requests other than GET are not cached
+	doGet(t, transport, ts.URL+"/repos/org/app/pulls", "Bearer b")
+	if server.ifNoneMatch[2] != "" {
+		t.Errorf("expected no If-None-Match for another token, got %q", server.ifNoneMatch[2])
+	}
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/repos/org/app/statuses/sha", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(transport.entries) != 2 {
+		t.Errorf("expected 2 cached responses, got %d", len(transport.entries))
+	}
+
+	transport.evict("a")
+	if len(transport.entries) != 1 {
+		t.Errorf("expected the responses of the evicted token to be removed, got %d cached responses", len(transport.entries))
+	}
+}
+
+func TestGHETagTransportBounded(t *testing.T) {
+	ts := httptest.NewServer(&etagServer{})
+	defer ts.Close()
+	transport := &ghETagTransport{base: http.DefaultTransport, entries: map[string]*ghETagEntry{}}
+
+	for i := 0; i < GH_ETAG_CACHE_MAX_ENTRIES+10; i++ {
+		doGet(t, transport, fmt.Sprintf("%s/repos/org/app/pulls/%d", ts.URL, i), "Bearer a")
+	}
+	if len(transport.entries) != GH_ETAG_CACHE_MAX_ENTRIES {
+		t.Errorf("expected the cache to be bounded to %d entries, got %d", GH_ETAG_CACHE_MAX_ENTRIES, len(transport.entries))
+	}
+}
+
+func TestGHRateTransport(t *testing.T) {
+	server := &etagServer{remaining: 100}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	transport := &ghRateTransport{base: http.DefaultTransport}
+
+	doGet(t, transport, ts.URL+"/repos/org/app/pulls", "")
+	if _, ok := transport.get(); ok {
+		t.Error("expected no rate limit for a response without rate limit headers")
+	}
+
+	server.rateHeaders = true
+	doGet(t, transport, ts.URL+"/repos/org/app/pulls", "")
+	rate, ok := transport.get()
+	if !ok {
+		t.Fatal("expected the rate limit to be recorded")
+	}
+	if rate.Limit != 5000 || rate.Remaining != 99 || !rate.Reset.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected rate limit %+v", rate)
+	}
+}
+
+func TestIsGHRateLimitLow(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		rate     github.Rate
+		expected bool
+	}{
+		{name: "no rate limit seen", rate: github.Rate{}, expected: false},
+		{name: "enough requests remaining", rate: github.Rate{Limit: 5000, Remaining: GH_RATE_LIMIT_MIN_REMAINING, Reset: github.Timestamp{Time: now.Add(time.Hour)}}, expected: false},
+		{name: "low before the reset", rate: github.Rate{Limit: 5000, Remaining: GH_RATE_LIMIT_MIN_REMAINING - 1, Reset: github.Timestamp{Time: now.Add(time.Hour)}}, expected: true},
+		{name: "low after the reset", rate: github.Rate{Limit: 5000, Remaining: 0, Reset: github.Timestamp{Time: now.Add(-time.Second)}}, expected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if low := isGHRateLimitLow(tc.rate, now); low != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, low)
+			}
+		})
+	}
+}
+
+func TestGHClientCacheTokenRotation(t *testing.T) {
+	server := &etagServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	cache := newGHClientCache(http.DefaultTransport)
+
+	repo := GHRepo{User: "org", Repo: "app", Token: "old", TokenSecret: "default/gh-app/token"}
+	other := GHRepo{User: "org", Repo: "other", Token: "other", TokenSecret: "default/gh-other/token"}
+	oldClient := cache.get(repo)
+	if cache.get(repo) != oldClient {
+		t.Error("expected the client to be reused for the same token")
+	}
+	for _, ghRepo := range []GHRepo{repo, other} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/repos/org/"+ghRepo.Repo+"/pulls", nil)
+		resp, err := cache.get(ghRepo).client.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	repo.Token = "new"
+	newClient := cache.get(repo)
+	if newClient == oldClient || newClient.token != "new" {
+		t.Error("expected a new client for the rotated token")
+	}
+	if len(cache.clients) != 2 {
+		t.Errorf("expected the client of the old token to be replaced, got %d clients", len(cache.clients))
+	}
+	if len(cache.transport.entries) != 1 {
+		t.Errorf("expected only the responses of the old token to be evicted, got %d cached responses", len(cache.transport.entries))
+	}
+}
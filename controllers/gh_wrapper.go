@@ -22,34 +22,86 @@ import (
 	"time"
 
 	"github.com/google/go-github/v45/github"
-	"golang.org/x/oauth2"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Maximum length of the description of a Github commit status
+const GH_STATUS_DESCRIPTION_MAX_LENGTH = 140
+
 type PRDetails struct {
 	Number         int
+	Merged         bool
 	MergeCommitSHA string
 	HeadSHA        string
 	State          string
+	CreatedAt      time.Time
 	ClosedAt       time.Time
+	Title          string
+	Branch         string
+	Author         string
+	Labels         []string
 }
 
-func GetGHClient(ghToken string) *github.Client {
+// GHRepo is the Github repository of the PREphemeralEnvController being reconciled, along with the token used to
+// access it and the Secret key it was read from. It is carried in the context of each reconcile, as several
+// PREphemeralEnvControllers can be reconciled at once by the same reconciler
+type GHRepo struct {
+	User        string
+	Repo        string
+	Token       string
+	TokenSecret string
+}
 
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: ghToken},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+type ghRepoContextKey struct{}
 
-	return github.NewClient(tc)
+// Returns a copy of the context carrying the Github repository passed
+func WithGHRepo(ctx context.Context, ghRepo GHRepo) context.Context {
+	return context.WithValue(ctx, ghRepoContextKey{}, ghRepo)
+}
 
+// Returns the Github repository carried in the context, along with its client
+func getGHRepo(ctx context.Context) (GHRepo, *github.Client, error) {
+	ghRepo, ok := ctx.Value(ghRepoContextKey{}).(GHRepo)
+	if !ok || ghRepo.Token == "" {
+		return GHRepo{}, nil, fmt.Errorf("no github repository in the context")
+	}
+	return ghRepo, GetGHClient(ghRepo), nil
 }
 
-func (r *PREphemeralEnvControllerReconciler) GetActivePullRequests() ([]PRDetails, error) {
+// Returns the Github client of the token, clients are shared by all reconciles along with their HTTP cache
+func GetGHClient(ghRepo GHRepo) *github.Client {
+	return ghClients.get(ghRepo).client
+}
 
-	ghClient := GetGHClient(r.GHPATToken)
-	if ghClient == nil {
-		return nil, fmt.Errorf("failed to get github client")
+func newPRDetails(pullRequest *github.PullRequest) PRDetails {
+	var labels []string
+	for _, label := range pullRequest.Labels {
+		labels = append(labels, label.GetName())
+	}
+	return PRDetails{
+		Number:         pullRequest.GetNumber(),
+		Merged:         pullRequest.GetMerged(),
+		MergeCommitSHA: pullRequest.GetMergeCommitSHA(),
+		HeadSHA:        pullRequest.GetHead().GetSHA(),
+		State:          pullRequest.GetState(),
+		CreatedAt:      pullRequest.GetCreatedAt(),
+		ClosedAt:       pullRequest.GetClosedAt(),
+		Title:          pullRequest.GetTitle(),
+		Branch:         pullRequest.GetHead().GetRef(),
+		Author:         pullRequest.GetUser().GetLogin(),
+		Labels:         labels,
+	}
+}
+
+func (r *PREphemeralEnvControllerReconciler) GetActivePullRequests(ctx context.Context) (_ []PRDetails, err error) {
+	ctx, span := r.startSpan(ctx, "GetActivePullRequests")
+	defer func() { endSpan(span, err) }()
+
+	ghRepo, ghClient, err := getGHRepo(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	var activePullRequests []PRDetails
@@ -59,7 +111,9 @@ func (r *PREphemeralEnvControllerReconciler) GetActivePullRequests() ([]PRDetail
 		State: "open",
 	}
 
-	pullRequests, _, err := ghClient.PullRequests.List(context.Background(), r.GHPRRepo.User, r.GHPRRepo.Repo, opts)
+	start := time.Now()
+	pullRequests, resp, err := ghClient.PullRequests.List(ctx, ghRepo.User, ghRepo.Repo, opts)
+	recordGHRequest(ghRepo, "list_pull_requests", start, resp, err)
 
 	if err != nil {
 		return nil, err
@@ -67,34 +121,90 @@ func (r *PREphemeralEnvControllerReconciler) GetActivePullRequests() ([]PRDetail
 
 	for _, pullRequest := range pullRequests {
 		if !pullRequest.GetMerged() {
-			prD := PRDetails{
-				Number:         pullRequest.GetNumber(),
-				MergeCommitSHA: pullRequest.GetMergeCommitSHA(),
-				HeadSHA:        pullRequest.GetHead().GetSHA(),
-				State:          pullRequest.GetState(),
-				ClosedAt:       pullRequest.GetClosedAt(),
-			}
-			activePullRequests = append(activePullRequests, prD)
+			activePullRequests = append(activePullRequests, newPRDetails(pullRequest))
 		}
 	}
 
 	return activePullRequests, nil
 }
 
-func (r *PREphemeralEnvControllerReconciler) UpdatePRStatus(context context.Context, prNumber int, prSHA string, status string, description string) error {
+// Gets a single PR, whether it is open or closed. Used to find out if a PR which is no longer open was merged
+func (r *PREphemeralEnvControllerReconciler) GetPullRequest(ctx context.Context, prNumber int) (PRDetails, error) {
+
+	ghRepo, ghClient, err := getGHRepo(ctx)
+	if err != nil {
+		return PRDetails{}, err
+	}
+
+	start := time.Now()
+	pullRequest, resp, err := ghClient.PullRequests.Get(ctx, ghRepo.User, ghRepo.Repo, prNumber)
+	recordGHRequest(ghRepo, "get_pull_request", start, resp, err)
+	if err != nil {
+		return PRDetails{}, err
+	}
+
+	return newPRDetails(pullRequest), nil
+}
+
+func (r *PREphemeralEnvControllerReconciler) UpdatePRStatus(context context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int, prSHA string, status string, description string) error {
+	return r.UpdatePRStatusWithContext(context, prController, prNumber, prSHA, "", status, description)
+}
+
+// Updates the PR status for the status context passed, like the status of a single health check. The default
+// context is used if statusContext is empty. The status last reported for each context is recorded in the status
+// of the environment of the PR, and Github is only called when the state or description changes
+func (r *PREphemeralEnvControllerReconciler) UpdatePRStatusWithContext(context context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int, prSHA string, statusContext string, status string, description string) (err error) {
+	context, span := r.startSpan(context, "UpdatePRStatus", withPRAttributes(prNumber, prSHA), trace.WithAttributes(attribute.String("status.context", statusContext), attribute.String("status.state", status)))
+	defer func() { endSpan(span, err) }()
 
-	ghClient := GetGHClient(r.GHPATToken)
-	if ghClient == nil {
-		return fmt.Errorf("failed to get github client")
+	if len(description) > GH_STATUS_DESCRIPTION_MAX_LENGTH {
+		description = description[:GH_STATUS_DESCRIPTION_MAX_LENGTH]
+	}
+	envStatus := findPREnvStatus(prController, prNumber)
+	if envStatus != nil && isPRStatusReported(envStatus, statusContext, prSHA, status, description) {
+		span.SetAttributes(attribute.Bool("status.skipped", true))
+		return nil
+	}
+
+	ghRepo, ghClient, err := getGHRepo(context)
+	if err != nil {
+		return err
 	}
 
 	repoStatus := &github.RepoStatus{
 		State:       &status,
 		Description: &description,
 	}
+	if statusContext != "" {
+		repoStatus.Context = &statusContext
+	}
+
+	start := time.Now()
+	_, resp, err := ghClient.Repositories.CreateStatus(context, ghRepo.User, ghRepo.Repo, prSHA, repoStatus)
+	recordGHRequest(ghRepo, "create_status", start, resp, err)
 
-	_, _, err := ghClient.Repositories.CreateStatus(context, r.GHPRRepo.User, r.GHPRRepo.Repo, prSHA, repoStatus)
+	if err != nil {
+		return err
+	}
+
+	if envStatus != nil {
+		recordPRStatus(envStatus, statusContext, prSHA, status, description)
+	}
+	return nil
+}
+
+// Adds a comment to the PR, like the log of a failed smoke test
+func (r *PREphemeralEnvControllerReconciler) CreatePRComment(ctx context.Context, prNumber int, body string) error {
+
+	ghRepo, ghClient, err := getGHRepo(ctx)
+	if err != nil {
+		return err
+	}
 
+	comment := &github.IssueComment{Body: &body}
+	start := time.Now()
+	_, resp, err := ghClient.Issues.CreateComment(ctx, ghRepo.User, ghRepo.Repo, prNumber, comment)
+	recordGHRequest(ghRepo, "create_comment", start, resp, err)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_NAME          = "default"
+	HEALTH_CHECK_STATUS_CONTEXT_PREFIX = "pr-ephemeral-env/"
+	FAILED_PROBE_MIN_BACKOFF           = time.Minute
+	FAILED_PROBE_MAX_BACKOFF           = 30 * time.Minute
+)
+
+// Returns the health checks of the CRD. The single healthCheck, or the deprecated envHealthCheckURLTemplate if no
+// health check is set, is returned as a check named "default" along with the named healthChecks
+func getHealthChecks(spec prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec) []prcontrollerephemeralenviov1alpha1.HealthCheck {
+	var healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck
+	switch {
+	case spec.HealthCheck != nil:
+		healthCheck := *spec.HealthCheck
+		if healthCheck.Name == "" {
+			healthCheck.Name = DEFAULT_HEALTH_CHECK_NAME
+		}
+		healthChecks = append(healthChecks, healthCheck)
+	case spec.EnvHealthCheckURLTemplate != "" && len(spec.HealthChecks) == 0:
+		healthChecks = append(healthChecks, prcontrollerephemeralenviov1alpha1.HealthCheck{
+			Name:        DEFAULT_HEALTH_CHECK_NAME,
+			URLTemplate: spec.EnvHealthCheckURLTemplate,
+		})
+	}
+	return append(healthChecks, spec.HealthChecks...)
+}
+
+// Validates that the health checks have unique names and a single target, and that their body regexes compile
+func ValidateHealthChecks(healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck) error {
+	names := map[string]bool{}
+	for _, healthCheck := range healthChecks {
+		if healthCheck.Name == "" {
+			return fmt.Errorf("health check for %q has no name", healthCheck.URLTemplate)
+		}
+		if names[healthCheck.Name] {
+			return fmt.Errorf("duplicate health check name %q", healthCheck.Name)
+		}
+		names[healthCheck.Name] = true
+		if (healthCheck.URLTemplate == "") == (healthCheck.Service == nil) {
+			return fmt.Errorf("health check %s must set exactly one of urlTemplate and service", healthCheck.Name)
+		}
+		if service := healthCheck.Service; service != nil && service.Access == prcontrollerephemeralenviov1alpha1.ServiceAccessAPIServerProxy {
+			if healthCheck.Type != "" && healthCheck.Type != prcontrollerephemeralenviov1alpha1.ProbeTypeHTTP {
+				return fmt.Errorf("health check %s of type %s cannot use the API server proxy", healthCheck.Name, healthCheck.Type)
+			}
+			if healthCheck.BearerTokenSecretRef != nil {
+				return fmt.Errorf("health check %s cannot send a bearer token through the API server proxy", healthCheck.Name)
+			}
+		}
+		if healthCheck.BodyRegex == "" {
+			continue
+		}
+		if _, err := regexp.Compile(healthCheck.BodyRegex); err != nil {
+			return fmt.Errorf("invalid bodyRegex %q of health check %s: %w", healthCheck.BodyRegex, healthCheck.Name, err)
+		}
+	}
+	return nil
+}
+
+func findProbeStatus(probes []prcontrollerephemeralenviov1alpha1.ProbeStatus, name string) *prcontrollerephemeralenviov1alpha1.ProbeStatus {
+	for i := range probes {
+		if probes[i].Name == name {
+			return &probes[i]
+		}
+	}
+	return nil
+}
+
+// Returns the bearer token of the Secret key referenced. The Secret is always looked up in the namespace of the
+// PREphemeralEnvController passed, the namespace of the reference is ignored so that Secrets of other namespaces
+// can not be sent to the environments
+func (r *PREphemeralEnvControllerReconciler) getBearerToken(ctx context.Context, secretRef *prcontrollerephemeralenviov1alpha1.SecretRef, controllerNamespace string) (string, error) {
+	if secretRef == nil {
+		return "", nil
+	}
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: controllerNamespace, Name: secretRef.Name}, secret); err != nil {
+		return "", fmt.Errorf("unable to fetch bearer token Secret %s/%s: %w", controllerNamespace, secretRef.Name, err)
+	}
+	token, ok := secret.Data[secretRef.Key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in bearer token Secret %s/%s", secretRef.Key, controllerNamespace, secretRef.Name)
+	}
+	return string(token), nil
+}
+
+// Returns the address of the Service probed by the health check inside the cluster, as a URL for http probes, as
+// host:port for tcp and grpc probes and as the host name for dns probes
+func getServiceTarget(healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, namespace string, prDetails PRDetails) string {
+	service := healthCheck.Service
+	host := fmt.Sprintf("%s.%s.svc", replacePRPlaceholders(service.Name, prDetails.Number, prDetails.HeadSHA), namespace)
+	address := fmt.Sprintf("%s:%d", host, service.Port)
+
+	switch healthCheck.Type {
+	case prcontrollerephemeralenviov1alpha1.ProbeTypeTCP, prcontrollerephemeralenviov1alpha1.ProbeTypeGRPC:
+		return address
+	case prcontrollerephemeralenviov1alpha1.ProbeTypeDNS:
+		return host
+	}
+	return fmt.Sprintf("%s://%s%s", getServiceScheme(service), address, getServicePath(service, prDetails))
+}
+
+// Returns the URL of the Service probed by the health check, through the service proxy of the Kubernetes API server
+func getServiceProxyURL(apiServerHost string, healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, namespace string, prDetails PRDetails) string {
+	service := healthCheck.Service
+	name := replacePRPlaceholders(service.Name, prDetails.Number, prDetails.HeadSHA)
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s:%s:%d/proxy%s", strings.TrimSuffix(apiServerHost, "/"),
+		url.PathEscape(namespace), getServiceScheme(service), url.PathEscape(name), service.Port, getServicePath(service, prDetails))
+}
+
+func getServiceScheme(service *prcontrollerephemeralenviov1alpha1.ServiceTarget) string {
+	if service.Scheme == "" {
+		return "http"
+	}
+	return service.Scheme
+}
+
+func getServicePath(service *prcontrollerephemeralenviov1alpha1.ServiceTarget, prDetails PRDetails) string {
+	path := replacePRPlaceholders(service.Path, prDetails.Number, prDetails.HeadSHA)
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Probes a single health check of the environment of the PR. Services without a namespace are looked up in the
+// namespace passed, which the environment is deployed to, and the bearer token in the namespace of the controller
+func (r *PREphemeralEnvControllerReconciler) probeHealthCheck(ctx context.Context, healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, prDetails PRDetails, namespace string, controllerNamespace string) ProbeResult {
+	bearerToken, err := r.getBearerToken(ctx, healthCheck.BearerTokenSecretRef, controllerNamespace)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
+	}
+
+	service := healthCheck.Service
+	if service == nil {
+		target := replacePRPlaceholders(healthCheck.URLTemplate, prDetails.Number, prDetails.HeadSHA)
+		return Probe(ctx, healthCheck, target, bearerToken, nil)
+	}
+	if service.Namespace != "" {
+		namespace = replacePRPlaceholders(service.Namespace, prDetails.Number, prDetails.HeadSHA)
+	}
+	if service.Access != prcontrollerephemeralenviov1alpha1.ServiceAccessAPIServerProxy {
+		return Probe(ctx, healthCheck, getServiceTarget(healthCheck, namespace, prDetails), bearerToken, nil)
+	}
+
+	if r.Config == nil {
+		return ProbeResult{Message: "no Kubernetes API server config to probe the Service through the API server proxy"}
+	}
+	httpClient, err := rest.HTTPClientFor(r.Config)
+	if err != nil {
+		return ProbeResult{Message: fmt.Sprintf("unable to create Kubernetes API server client: %v", err)}
+	}
+	return Probe(ctx, healthCheck, getServiceProxyURL(r.Config.Host, healthCheck, namespace, prDetails), "", httpClient)
+}
+
+// Schedules each health check of the environment of the PR deployed to the namespace passed with the HealthProber,
+// and records the cached results in the status of the environment. When there are multiple checks, the result of
+// each check is reported as a separate Github PR status whenever it changes. Returns true once every check which is
+// not optional reached its success threshold
+func (r *PREphemeralEnvControllerReconciler) CheckEnvHealth(ctx context.Context, healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck, prDetails PRDetails, namespace string, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) bool {
+	logger := log.FromContext(ctx)
+
+	owner := types.NamespacedName{Namespace: prController.Namespace, Name: prController.Name}
+	interval := getProbeInterval(envStatus, now)
+
+	ready := true
+	var probes []prcontrollerephemeralenviov1alpha1.ProbeStatus
+	for i := range healthChecks {
+		healthCheck := healthChecks[i]
+		successThreshold := healthCheck.SuccessThreshold
+		if successThreshold < 1 {
+			successThreshold = 1
+		}
+
+		key := ProbeKey{Owner: owner, PRNumber: prDetails.Number, HeadSHA: prDetails.HeadSHA, Name: healthCheck.Name}
+		// Probes run in the background, their spans are linked to the reconcile which scheduled them
+		reconcileLink := trace.LinkFromContext(ctx)
+		r.Prober.Schedule(key, interval, successThreshold, func(ctx context.Context) ProbeResult {
+			ctx, span := r.startSpan(ctx, "HealthProbe", withPRAttributes(prDetails.Number, prDetails.HeadSHA),
+				trace.WithAttributes(HEALTH_CHECK_ATTRIBUTE.String(healthCheck.Name)), trace.WithLinks(reconcileLink))
+			defer span.End()
+			result := r.probeHealthCheck(ctx, &healthCheck, prDetails, namespace, owner.Namespace)
+			span.SetAttributes(attribute.Bool("probe.success", result.Success))
+			if !result.Success {
+				span.SetStatus(codes.Error, result.Message)
+			}
+			return result
+		}, now.Time)
+		result, ok := r.Prober.Result(key)
+		if !ok {
+			if !healthCheck.Optional {
+				ready = false
+			}
+			continue
+		}
+
+		previous := findProbeStatus(envStatus.HealthChecks, healthCheck.Name)
+		probes = append(probes, prcontrollerephemeralenviov1alpha1.ProbeStatus{
+			Name:                 healthCheck.Name,
+			Time:                 result.Time,
+			Success:              result.Success,
+			StatusCode:           result.StatusCode,
+			Message:              result.Message,
+			ConsecutiveSuccesses: result.ConsecutiveSuccesses,
+		})
+
+		passed := result.ConsecutiveSuccesses >= successThreshold
+		if !passed && !healthCheck.Optional {
+			ready = false
+		}
+
+		if len(healthChecks) > 1 && (previous == nil || previous.Success != result.Success) {
+			prStatus, description := "success", fmt.Sprintf("Health check %s passed", healthCheck.Name)
+			if !result.Success {
+				prStatus, description = "pending", fmt.Sprintf("Health check %s failed: %s", healthCheck.Name, result.Message)
+			}
+			if err := r.UpdatePRStatusWithContext(ctx, prController, prDetails.Number, prDetails.HeadSHA, HEALTH_CHECK_STATUS_CONTEXT_PREFIX+healthCheck.Name, prStatus, description); err != nil {
+				logger.Error(err, "unable to update PR status of health check", "healthCheck", healthCheck.Name)
+			}
+		}
+	}
+	envStatus.HealthChecks = probes
+	return ready
+}
+
+// Returns true if the environment did not pass its health checks within the readiness timeout since it was deployed
+func isReadinessTimedOut(spec prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, now metav1.Time) bool {
+	if spec.ReadinessTimeout == nil || spec.ReadinessTimeout.Duration <= 0 || envStatus.ReadyAt != nil || envStatus.LastCommitAt == nil {
+		return false
+	}
+	return now.Sub(envStatus.LastCommitAt.Time) > spec.ReadinessTimeout.Duration
+}
+
+// Returns the interval at which the health checks of the environment are probed. Failed environments are probed with
+// a slower backoff, which grows with the time since the environment failed, between FAILED_PROBE_MIN_BACKOFF and
+// FAILED_PROBE_MAX_BACKOFF
+func getProbeInterval(envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, now metav1.Time) time.Duration {
+	if envStatus.Phase != prcontrollerephemeralenviov1alpha1.EnvPhaseFailed || envStatus.FailedAt == nil {
+		return DEFAULT_PROBE_INTERVAL
+	}
+	backoff := now.Sub(envStatus.FailedAt.Time)
+	if backoff < FAILED_PROBE_MIN_BACKOFF {
+		backoff = FAILED_PROBE_MIN_BACKOFF
+	}
+	if backoff > FAILED_PROBE_MAX_BACKOFF {
+		backoff = FAILED_PROBE_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// Returns the error of the last failed probe of a health check which is not optional
+func getLastProbeError(healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus) string {
+	for _, healthCheck := range healthChecks {
+		probe := findProbeStatus(envStatus.HealthChecks, healthCheck.Name)
+		if healthCheck.Optional || probe == nil || probe.Success {
+			continue
+		}
+		return fmt.Sprintf("health check %s failed: %s", healthCheck.Name, probe.Message)
+	}
+	return "health checks did not pass"
+}
+
+// Marks the environment of the PR as Failed once it did not pass its health checks within the readiness timeout, and
+// sets the Github PR status to failure with the last probe error
+func (r *PREphemeralEnvControllerReconciler) FailEnvReadiness(ctx context.Context, healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck, prDetails PRDetails, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) {
+	logger := log.FromContext(ctx)
+
+	probeError := getLastProbeError(healthChecks, envStatus)
+	envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseFailed
+	envStatus.FailedAt = &now
+	envStatus.Message = fmt.Sprintf("Environment not ready within the readiness timeout of %s, %s", prController.Spec.ReadinessTimeout.Duration, probeError)
+
+	mesg := fmt.Sprintf("Environment for PR %d not ready within the readiness timeout, %s", prDetails.Number, probeError)
+	r.Record.Event(prController, "Warning", "EnvReadinessTimeout", mesg)
+	logger.Info(mesg)
+	if err := r.UpdatePRStatus(ctx, prController, prDetails.Number, prDetails.HeadSHA, "failure", "Environment not ready: "+probeError); err != nil {
+		logger.Error(err, "unable to update PR status")
+	}
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetHealthChecks(t *testing.T) {
+	api := prcontrollerephemeralenviov1alpha1.HealthCheck{Name: "api", URLTemplate: "https://api.pr-<<PR_NUMBER>>.example.com/healthz"}
+	web := prcontrollerephemeralenviov1alpha1.HealthCheck{Name: "web", URLTemplate: "https://pr-<<PR_NUMBER>>.example.com"}
+	for _, tc := range []struct {
+		name     string
+		spec     prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec
+		expected []string
+	}{
+		{name: "none"},
+		{name: "deprecated URL template", spec: prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{EnvHealthCheckURLTemplate: "https://pr-<<PR_NUMBER>>.example.com"}, expected: []string{"default"}},
+		{name: "unnamed healthCheck", spec: prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{HealthCheck: &prcontrollerephemeralenviov1alpha1.HealthCheck{URLTemplate: web.URLTemplate}}, expected: []string{"default"}},
+		{name: "named healthChecks", spec: prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{HealthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{api, web}}, expected: []string{"api", "web"}},
+		{
+			name:     "deprecated URL template ignored with healthChecks",
+			spec:     prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{EnvHealthCheckURLTemplate: "https://pr-<<PR_NUMBER>>.example.com", HealthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{api}},
+			expected: []string{"api"},
+		},
+		{
+			name:     "healthCheck first",
+			spec:     prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{HealthCheck: &web, HealthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{api}},
+			expected: []string{"web", "api"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			for _, healthCheck := range getHealthChecks(tc.spec) {
+				names = append(names, healthCheck.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected the health checks %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestValidateHealthChecks(t *testing.T) {
+	apiURL := "https://api.pr-<<PR_NUMBER>>.example.com/healthz"
+	webService := &prcontrollerephemeralenviov1alpha1.ServiceTarget{Name: "web", Port: 8080}
+	proxiedService := &prcontrollerephemeralenviov1alpha1.ServiceTarget{Name: "web", Port: 8080, Access: prcontrollerephemeralenviov1alpha1.ServiceAccessAPIServerProxy}
+	for _, tc := range []struct {
+		name         string
+		healthChecks []prcontrollerephemeralenviov1alpha1.HealthCheck
+		wantErr      bool
+	}{
+		{name: "valid", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "api", URLTemplate: apiURL, BodyRegex: `"status":\s*"ok"`}, {Name: "web", Service: webService}}},
+		{name: "missing name", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{URLTemplate: apiURL}}, wantErr: true},
+		{name: "duplicate name", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "api", URLTemplate: apiURL}, {Name: "api", URLTemplate: apiURL}}, wantErr: true},
+		{name: "invalid body regex", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "api", URLTemplate: apiURL, BodyRegex: "[a-"}}, wantErr: true},
+		{name: "no target", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "api"}}, wantErr: true},
+		{name: "URL and Service", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "web", URLTemplate: apiURL, Service: webService}}, wantErr: true},
+		{name: "tcp probe through the API server proxy", healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "web", Type: prcontrollerephemeralenviov1alpha1.ProbeTypeTCP, Service: proxiedService}}, wantErr: true},
+		{
+			name:         "bearer token through the API server proxy",
+			healthChecks: []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "web", Service: proxiedService, BearerTokenSecretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{Name: "probe-token", Key: "token"}}},
+			wantErr:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateHealthChecks(tc.healthChecks); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIsReadinessTimedOut(t *testing.T) {
+	deployedAt := metav1.NewTime(time.Date(2022, 10, 6, 14, 0, 0, 0, time.UTC))
+	after := func(d time.Duration) metav1.Time {
+		return metav1.NewTime(deployedAt.Add(d))
+	}
+	readyAt := after(2 * time.Minute)
+	for _, tc := range []struct {
+		name     string
+		timeout  *metav1.Duration
+		readyAt  *metav1.Time
+		now      metav1.Time
+		expected bool
+	}{
+		{name: "no readiness timeout", now: after(time.Hour)},
+		{name: "within the timeout", timeout: &metav1.Duration{Duration: 15 * time.Minute}, now: after(10 * time.Minute)},
+		{name: "timed out", timeout: &metav1.Duration{Duration: 15 * time.Minute}, now: after(16 * time.Minute), expected: true},
+		{name: "was ready once", timeout: &metav1.Duration{Duration: 15 * time.Minute}, readyAt: &readyAt, now: after(16 * time.Minute)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{ReadinessTimeout: tc.timeout}
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{LastCommitAt: &deployedAt, ReadyAt: tc.readyAt}
+			if timedOut := isReadinessTimedOut(spec, envStatus, tc.now); timedOut != tc.expected {
+				t.Errorf("expected timed out %v, got %v", tc.expected, timedOut)
+			}
+		})
+	}
+}
+
+func TestGetProbeInterval(t *testing.T) {
+	failedAt := metav1.NewTime(time.Date(2022, 10, 6, 14, 15, 0, 0, time.UTC))
+	after := func(d time.Duration) metav1.Time {
+		return metav1.NewTime(failedAt.Add(d))
+	}
+	for _, tc := range []struct {
+		name     string
+		phase    string
+		failedAt *metav1.Time
+		now      metav1.Time
+		expected time.Duration
+	}{
+		{name: "active", phase: prcontrollerephemeralenviov1alpha1.EnvPhaseActive, now: after(0), expected: DEFAULT_PROBE_INTERVAL},
+		{name: "minimum backoff", phase: prcontrollerephemeralenviov1alpha1.EnvPhaseFailed, failedAt: &failedAt, now: after(10 * time.Second), expected: FAILED_PROBE_MIN_BACKOFF},
+		{name: "backoff grows with the failure age", phase: prcontrollerephemeralenviov1alpha1.EnvPhaseFailed, failedAt: &failedAt, now: after(10 * time.Minute), expected: 10 * time.Minute},
+		{name: "maximum backoff", phase: prcontrollerephemeralenviov1alpha1.EnvPhaseFailed, failedAt: &failedAt, now: after(5 * time.Hour), expected: FAILED_PROBE_MAX_BACKOFF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{Phase: tc.phase, FailedAt: tc.failedAt}
+			if interval := getProbeInterval(envStatus, tc.now); interval != tc.expected {
+				t.Errorf("expected an interval of %s, got %s", tc.expected, interval)
+			}
+		})
+	}
+}
+
+func TestCheckEnvHealth(t *testing.T) {
+	var webHealthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !webHealthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	prober := NewHealthProber(1)
+	r := &PREphemeralEnvControllerReconciler{Prober: prober}
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+	healthChecks := []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "web", URLTemplate: server.URL + "/pr-<<PR_NUMBER>>", SuccessThreshold: 2}}
+	envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{}
+	start := time.Now()
+
+	if ready := r.CheckEnvHealth(context.Background(), healthChecks, testPRDetails, "envs", envStatus, prController, metav1.NewTime(start)); ready || len(envStatus.HealthChecks) != 0 {
+		t.Fatalf("expected the environment not to be ready before the first probe, got ready %v with %+v", ready, envStatus.HealthChecks)
+	}
+
+	for i, step := range []struct {
+		webHealthy           bool
+		ready                bool
+		consecutiveSuccesses int
+	}{
+		{webHealthy: true, ready: false, consecutiveSuccesses: 1},
+		{webHealthy: true, ready: true, consecutiveSuccesses: 2},
+		{webHealthy: false, ready: false, consecutiveSuccesses: 0},
+		{webHealthy: true, ready: false, consecutiveSuccesses: 1},
+	} {
+		webHealthy.Store(step.webHealthy)
+		// Runs the probes like a tick of the prober, the interval elapsed since the previous step
+		now := start.Add(time.Duration(i) * time.Hour)
+		for _, key := range prober.dueProbes(now) {
+			prober.runProbe(context.Background(), key)
+		}
+
+		if ready := r.CheckEnvHealth(context.Background(), healthChecks, testPRDetails, "envs", envStatus, prController, metav1.NewTime(now)); ready != step.ready {
+			t.Errorf("probe %d: expected ready %v, got %v", i, step.ready, ready)
+		}
+		if web := findProbeStatus(envStatus.HealthChecks, "web"); web == nil || web.ConsecutiveSuccesses != step.consecutiveSuccesses {
+			t.Errorf("probe %d: expected %d consecutive successes of web, got %+v", i, step.consecutiveSuccesses, web)
+		}
+	}
+
+	// A failing optional check does not block readiness
+	healthChecks[0].Optional = true
+	if ready := r.CheckEnvHealth(context.Background(), healthChecks, testPRDetails, "envs", envStatus, prController, metav1.NewTime(start)); !ready {
+		t.Error("expected a failing optional health check not to block readiness")
+	}
+}
+
+func TestGetLastProbeError(t *testing.T) {
+	healthChecks := []prcontrollerephemeralenviov1alpha1.HealthCheck{{Name: "metrics", Optional: true}, {Name: "web"}, {Name: "api"}}
+	envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{HealthChecks: []prcontrollerephemeralenviov1alpha1.ProbeStatus{
+		{Name: "metrics", Message: "connection refused"},
+		{Name: "web", Success: true},
+		{Name: "api", StatusCode: 502, Message: "unexpected status code 502"},
+	}}
+	if probeError := getLastProbeError(healthChecks, envStatus); probeError != "health check api failed: unexpected status code 502" {
+		t.Errorf("expected the error of the api health check, got %q", probeError)
+	}
+	envStatus.HealthChecks = nil
+	if probeError := getLastProbeError(healthChecks, envStatus); probeError != "health checks did not pass" {
+		t.Errorf("expected a generic error without probes, got %q", probeError)
+	}
+}
+
+func TestGetServiceTarget(t *testing.T) {
+	service := &prcontrollerephemeralenviov1alpha1.ServiceTarget{Name: "web-<<PR_NUMBER>>", Port: 8080, Path: "healthz/<<PR_HEAD_SHA>>"}
+	for _, tc := range []struct {
+		probeType string
+		scheme    string
+		expected  string
+	}{
+		{expected: "http://web-42.pr-42.svc:8080/healthz/a1b2c3d4e5f6a7b8"},
+		{probeType: prcontrollerephemeralenviov1alpha1.ProbeTypeHTTP, scheme: "https", expected: "https://web-42.pr-42.svc:8080/healthz/a1b2c3d4e5f6a7b8"},
+		{probeType: prcontrollerephemeralenviov1alpha1.ProbeTypeTCP, expected: "web-42.pr-42.svc:8080"},
+		{probeType: prcontrollerephemeralenviov1alpha1.ProbeTypeGRPC, expected: "web-42.pr-42.svc:8080"},
+		{probeType: prcontrollerephemeralenviov1alpha1.ProbeTypeDNS, expected: "web-42.pr-42.svc"},
+	} {
+		t.Run(tc.probeType+tc.scheme, func(t *testing.T) {
+			target := *service
+			target.Scheme = tc.scheme
+			healthCheck := &prcontrollerephemeralenviov1alpha1.HealthCheck{Name: "web", Type: tc.probeType, Service: &target}
+			if address := getServiceTarget(healthCheck, "pr-42", testPRDetails); address != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, address)
+			}
+		})
+	}
+}
+
+func TestGetBearerToken(t *testing.T) {
+	newTokenSecret := func(namespace, name, token string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Data: map[string][]byte{"token": []byte(token)}}
+	}
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			newTokenSecret("ci", "probe-token", "s3cr3t"),
+			newTokenSecret("kube-system", "probe-token", "cluster-admin"),
+			newTokenSecret("kube-system", "admin-token", "cluster-admin"),
+		).Build(),
+	}
+
+	for _, tc := range []struct {
+		name      string
+		secretRef *prcontrollerephemeralenviov1alpha1.SecretRef
+		expected  string
+		wantErr   bool
+	}{
+		{name: "no bearer token"},
+		{name: "namespace of the controller", secretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{Name: "probe-token", Namespace: "ci", Key: "token"}, expected: "s3cr3t"},
+		{name: "other namespace ignored", secretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{Name: "probe-token", Namespace: "kube-system", Key: "token"}, expected: "s3cr3t"},
+		{name: "only in other namespace", secretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{Name: "admin-token", Namespace: "kube-system", Key: "token"}, wantErr: true},
+		{name: "missing key", secretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{Name: "probe-token", Key: "password"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := r.getBearerToken(context.Background(), tc.secretRef, "ci")
+			if (err != nil) != tc.wantErr || token != tc.expected {
+				t.Errorf("expected the token %q with error %v, got %q with %v", tc.expected, tc.wantErr, token, err)
+			}
+		})
+	}
+}
+
+func TestProbeHealthCheckThroughAPIServerProxy(t *testing.T) {
+	paths := make(chan string, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths <- req.URL.Path
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer apiServer.Close()
+
+	r := &PREphemeralEnvControllerReconciler{Config: &rest.Config{Host: apiServer.URL + "/"}}
+	healthCheck := &prcontrollerephemeralenviov1alpha1.HealthCheck{
+		Name:      "web",
+		BodyRegex: `"ok"`,
+		Service: &prcontrollerephemeralenviov1alpha1.ServiceTarget{
+			Namespace: "shop-pr-<<PR_NUMBER>>",
+			Name:      "web",
+			Port:      8080,
+			Path:      "/healthz",
+			Access:    prcontrollerephemeralenviov1alpha1.ServiceAccessAPIServerProxy,
+		},
+	}
+	if result := r.probeHealthCheck(context.Background(), healthCheck, testPRDetails, "envs", "ci"); !result.Success {
+		t.Fatalf("expected the probe through the API server proxy to succeed, got %+v", result)
+	}
+	if path, expected := <-paths, "/api/v1/namespaces/shop-pr-42/services/http:web:8080/proxy/healthz"; path != expected {
+		t.Errorf("expected the proxy path %s, got %s", expected, path)
+	}
+
+	r.Config = nil
+	if result := r.probeHealthCheck(context.Background(), healthCheck, testPRDetails, "envs", "ci"); result.Success {
+		t.Errorf("expected the probe to fail without an API server config, got %+v", result)
+	}
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	DEFAULT_HEALTH_PROBE_WORKERS = 10
+	DEFAULT_PROBE_INTERVAL       = 10 * time.Second
+	PROBER_TICK_INTERVAL         = time.Second
+	PROBER_EVENTS_BUFFER_SIZE    = 1024
+)
+
+// ProbeKey identifies a health check of the environment of a PR, for the PR head SHA it was deployed for
+type ProbeKey struct {
+	Owner    types.NamespacedName
+	PRNumber int
+	HeadSHA  string
+	Name     string
+}
+
+// CachedProbeResult is the result of the last probe of a health check, as cached by the HealthProber
+type CachedProbeResult struct {
+	ProbeResult
+	Time                 metav1.Time
+	ConsecutiveSuccesses int
+}
+
+type probeTarget struct {
+	probe            func(ctx context.Context) ProbeResult
+	interval         time.Duration
+	successThreshold int
+	scheduledAt      time.Time
+	nextProbe        time.Time
+	inFlight         bool
+	result           *CachedProbeResult
+}
+
+// HealthProber probes the health checks of the PR environments in the background with a pool of workers, so that
+// Reconcile only reads the cached results. A reconcile of the owning controller object is triggered whenever the
+// result of a check changes. Reconcile triggers are coalesced per owner while they wait to be sent
+type HealthProber struct {
+	workers int
+	mu      sync.Mutex
+	targets map[ProbeKey]*probeTarget
+	pending map[types.NamespacedName]struct{}
+	notify  chan struct{}
+	events  chan event.GenericEvent
+}
+
+// Creates a HealthProber running the number of workers passed, DEFAULT_HEALTH_PROBE_WORKERS is used if it is not positive
+func NewHealthProber(workers int) *HealthProber {
+	if workers <= 0 {
+		workers = DEFAULT_HEALTH_PROBE_WORKERS
+	}
+	return &HealthProber{
+		workers: workers,
+		targets: map[ProbeKey]*probeTarget{},
+		pending: map[types.NamespacedName]struct{}{},
+		notify:  make(chan struct{}, 1),
+		events:  make(chan event.GenericEvent, PROBER_EVENTS_BUFFER_SIZE),
+	}
+}
+
+// Returns the channel of the events triggering a reconcile of the owner of a health check whose result changed
+func (p *HealthProber) Events() <-chan event.GenericEvent {
+	return p.events
+}
+
+// Schedules the health check to be probed every interval, starting immediately for a new check. The probe function,
+// interval and success threshold of a check which is already scheduled are updated
+func (p *HealthProber) Schedule(key ProbeKey, interval time.Duration, successThreshold int, probe func(ctx context.Context) ProbeResult, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	target, ok := p.targets[key]
+	if !ok {
+		target = &probeTarget{nextProbe: now}
+		p.targets[key] = target
+	} else if target.result != nil && interval != target.interval {
+		target.nextProbe = target.result.Time.Add(interval)
+	}
+	target.probe = probe
+	target.interval = interval
+	target.successThreshold = successThreshold
+	target.scheduledAt = now
+}
+
+// Returns the cached result of the last probe of the health check, false is returned if it was not probed yet
+func (p *HealthProber) Result(key ProbeKey) (CachedProbeResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	target, ok := p.targets[key]
+	if !ok || target.result == nil {
+		return CachedProbeResult{}, false
+	}
+	return *target.result, true
+}
+
+// Stops probing the health checks of the owner which were not scheduled since the time passed, like the checks of
+// PRs which were closed or of owners which were deleted
+func (p *HealthProber) Prune(owner types.NamespacedName, scheduledSince time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, target := range p.targets {
+		if key.Owner == owner && target.scheduledAt.Before(scheduledSince) {
+			delete(p.targets, key)
+		}
+	}
+}
+
+// Start runs the workers until the context is done, it implements the manager.Runnable interface
+func (p *HealthProber) Start(ctx context.Context) error {
+	jobs := make(chan ProbeKey)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				p.runProbe(ctx, key)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.sendEvents(ctx)
+	}()
+	defer wg.Wait()
+	defer close(jobs)
+
+	ticker := time.NewTicker(PROBER_TICK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, key := range p.dueProbes(time.Now()) {
+			select {
+			case jobs <- key:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// Returns the health checks which are due to be probed, and marks them as in flight
+func (p *HealthProber) dueProbes(now time.Time) []ProbeKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var due []ProbeKey
+	for key, target := range p.targets {
+		if !target.inFlight && !now.Before(target.nextProbe) {
+			target.inFlight = true
+			due = append(due, key)
+		}
+	}
+	return due
+}
+
+// Probes the health check and caches the result, triggering a reconcile of the owner if the result changed
+func (p *HealthProber) runProbe(ctx context.Context, key ProbeKey) {
+	p.mu.Lock()
+	target, ok := p.targets[key]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	probe := target.probe
+	p.mu.Unlock()
+
+	start := time.Now()
+	result := probe(ctx)
+	now := time.Now()
+	recordHealthProbe(key, result, now.Sub(start))
+
+	p.mu.Lock()
+	target, ok = p.targets[key]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	previous := target.result
+	consecutiveSuccesses := 0
+	if result.Success {
+		consecutiveSuccesses = 1
+		if previous != nil && previous.Success {
+			consecutiveSuccesses = previous.ConsecutiveSuccesses + 1
+		}
+	}
+	target.result = &CachedProbeResult{ProbeResult: result, Time: metav1.NewTime(now), ConsecutiveSuccesses: consecutiveSuccesses}
+	target.inFlight = false
+	target.nextProbe = now.Add(target.interval)
+	changed := previous == nil || previous.Success != result.Success || consecutiveSuccesses == target.successThreshold
+	p.mu.Unlock()
+
+	if changed {
+		p.triggerReconcile(key.Owner)
+	}
+}
+
+// Queues a reconcile of the owner. An owner which is already queued is only reconciled once
+func (p *HealthProber) triggerReconcile(owner types.NamespacedName) {
+	p.mu.Lock()
+	p.pending[owner] = struct{}{}
+	p.mu.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the owners queued for a reconcile, and clears the queue
+func (p *HealthProber) takePending() []types.NamespacedName {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owners := make([]types.NamespacedName, 0, len(p.pending))
+	for owner := range p.pending {
+		owners = append(owners, owner)
+	}
+	p.pending = map[types.NamespacedName]struct{}{}
+	return owners
+}
+
+// Sends the events of the owners queued for a reconcile until the context is done. Sending blocks while the events
+// channel is full, in the meantime new triggers of the same owners are coalesced in the queue
+func (p *HealthProber) sendEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.notify:
+		}
+		owners := p.takePending()
+		for i, key := range owners {
+			owner := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{}
+			owner.Name = key.Name
+			owner.Namespace = key.Namespace
+			select {
+			case p.events <- event.GenericEvent{Object: owner}:
+			case <-ctx.Done():
+				log.FromContext(ctx).Info("health prober stopped, dropping reconcile triggers", "owners", len(owners)-i)
+				return
+			}
+		}
+	}
+}
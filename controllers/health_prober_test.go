@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// stubProbe returns the results passed in turn, the last one is repeated once they are all returned
+type stubProbe struct {
+	results []bool
+	calls   int
+}
+
+func (s *stubProbe) probe(ctx context.Context) ProbeResult {
+	success := s.results[len(s.results)-1]
+	if s.calls < len(s.results) {
+		success = s.results[s.calls]
+	}
+	s.calls++
+	return ProbeResult{Success: success}
+}
+
+// Runs the probes which are due at the time passed, like a tick of the HealthProber, and returns their keys
+func runDueProbes(p *HealthProber, now time.Time) []ProbeKey {
+	due := p.dueProbes(now)
+	for _, key := range due {
+		p.runProbe(context.Background(), key)
+	}
+	return due
+}
+
+func TestHealthProberResult(t *testing.T) {
+	p := NewHealthProber(1)
+	owner := types.NamespacedName{Namespace: "default", Name: "app"}
+	key := ProbeKey{Owner: owner, PRNumber: 1, HeadSHA: "sha", Name: "web"}
+	stub := &stubProbe{results: []bool{true, true, false, true}}
+	now := time.Now()
+
+	p.Schedule(key, time.Minute, 1, stub.probe, now)
+	if _, ok := p.Result(key); ok {
+		t.Fatal("expected no result before the first probe")
+	}
+
+	for i, expected := range []struct {
+		success              bool
+		consecutiveSuccesses int
+	}{
+		{true, 1},
+		{true, 2},
+		{false, 0},
+		{true, 1},
+	} {
+		// Probes are due immediately for a new check, and then every interval
+		if due := runDueProbes(p, now.Add(time.Duration(i)*time.Hour)); len(due) != 1 {
+			t.Fatalf("probe %d: expected 1 due probe, got %d", i, len(due))
+		}
+		result, ok := p.Result(key)
+		if !ok {
+			t.Fatalf("probe %d: expected a result", i)
+		}
+		if result.Success != expected.success || result.ConsecutiveSuccesses != expected.consecutiveSuccesses {
+			t.Errorf("probe %d: got success %v with %d consecutive successes, expected %v with %d", i, result.Success, result.ConsecutiveSuccesses, expected.success, expected.consecutiveSuccesses)
+		}
+	}
+	if due := p.dueProbes(time.Now()); len(due) != 0 {
+		t.Errorf("expected no due probes before the interval elapsed, got %v", due)
+	}
+}
+
+func TestHealthProberSchedule(t *testing.T) {
+	p := NewHealthProber(1)
+	key := ProbeKey{Owner: types.NamespacedName{Namespace: "default", Name: "app"}, PRNumber: 1, Name: "web"}
+	now := time.Now()
+
+	p.Schedule(key, time.Hour, 1, (&stubProbe{results: []bool{true}}).probe, now)
+	if due := p.dueProbes(now); len(due) != 1 {
+		t.Fatalf("expected the new check to be due, got %v", due)
+	}
+	if due := p.dueProbes(now); len(due) != 0 {
+		t.Fatalf("expected the in flight check not to be due again, got %v", due)
+	}
+	p.runProbe(context.Background(), key)
+	probedAt, _ := p.Result(key)
+
+	// A shorter interval takes effect from the last probe
+	p.Schedule(key, time.Second, 1, (&stubProbe{results: []bool{false}}).probe, now)
+	if due := p.dueProbes(probedAt.Time.Add(time.Second)); len(due) != 1 {
+		t.Fatalf("expected the check to be due with the new interval, got %v", due)
+	}
+	p.runProbe(context.Background(), key)
+	if result, _ := p.Result(key); result.Success {
+		t.Error("expected the probe function to be replaced")
+	}
+}
+
+func TestHealthProberSuccessThreshold(t *testing.T) {
+	p := NewHealthProber(1)
+	owner := types.NamespacedName{Namespace: "default", Name: "app"}
+	key := ProbeKey{Owner: owner, PRNumber: 1, Name: "web"}
+	stub := &stubProbe{results: []bool{false, false, true, true, true, true, false}}
+	p.Schedule(key, time.Second, 3, stub.probe, time.Now())
+
+	// A reconcile is triggered by the first result, a change of the result, and reaching the success threshold
+	for i, expected := range []bool{true, false, true, false, true, false, true} {
+		runDueProbes(p, time.Now().Add(time.Duration(i)*time.Hour))
+		pending := p.takePending()
+		if triggered := len(pending) == 1 && pending[0] == owner; triggered != expected {
+			t.Errorf("probe %d: expected reconcile triggered %v, got pending owners %v", i, expected, pending)
+		}
+	}
+}
+
+func TestHealthProberPrune(t *testing.T) {
+	p := NewHealthProber(1)
+	owner := types.NamespacedName{Namespace: "default", Name: "app"}
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+	stale := ProbeKey{Owner: owner, PRNumber: 1, Name: "web"}
+	current := ProbeKey{Owner: owner, PRNumber: 2, Name: "web"}
+	otherOwner := ProbeKey{Owner: other, PRNumber: 1, Name: "web"}
+	probe := (&stubProbe{results: []bool{true}}).probe
+	now := time.Now()
+
+	p.Schedule(stale, time.Second, 1, probe, now.Add(-time.Minute))
+	p.Schedule(otherOwner, time.Second, 1, probe, now.Add(-time.Minute))
+	p.Schedule(current, time.Second, 1, probe, now)
+	runDueProbes(p, now)
+
+	p.Prune(owner, now)
+	if _, ok := p.Result(stale); ok {
+		t.Error("expected the check which was not scheduled since the reconcile to be pruned")
+	}
+	if _, ok := p.Result(current); !ok {
+		t.Error("expected the check scheduled during the reconcile to be kept")
+	}
+	if _, ok := p.Result(otherOwner); !ok {
+		t.Error("expected the checks of other owners to be kept")
+	}
+}
+
+// Triggers are coalesced per owner, and not dropped while the events channel is full
+func TestHealthProberEventsCoalesced(t *testing.T) {
+	p := NewHealthProber(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filler := types.NamespacedName{Namespace: "default", Name: "filler"}
+	for i := 0; i < PROBER_EVENTS_BUFFER_SIZE; i++ {
+		p.triggerReconcile(filler)
+		p.events <- event.GenericEvent{}
+	}
+	owners := []types.NamespacedName{{Namespace: "default", Name: "app-a"}, {Namespace: "default", Name: "app-b"}}
+	for i := 0; i < 2*PROBER_EVENTS_BUFFER_SIZE; i++ {
+		p.triggerReconcile(owners[i%len(owners)])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.sendEvents(ctx)
+	}()
+
+	var received []string
+	timeout := time.After(5 * time.Second)
+	// The events already buffered have no object
+	for len(received) < 3 {
+		select {
+		case e := <-p.Events():
+			if e.Object != nil {
+				received = append(received, client.ObjectKeyFromObject(e.Object).String())
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, received %v", received)
+		}
+	}
+	select {
+	case e := <-p.Events():
+		t.Errorf("unexpected event %v", e.Object)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	<-done
+
+	sort.Strings(received)
+	expected := []string{"default/app-a", "default/app-b", "default/filler"}
+	if len(received) != len(expected) {
+		t.Fatalf("expected one event per owner %v, got %v", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("expected one event per owner %v, got %v", expected, received)
+			break
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	SHORT_SHA_LENGTH      = 7
+	MAX_TITLE_SLUG_LENGTH = 63
+)
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// PRTemplateData is the PR metadata made available to the values template
+type PRTemplateData struct {
+	Number    int
+	HeadSHA   string
+	ShortSHA  string
+	Branch    string
+	Author    string
+	Labels    []string
+	TitleSlug string
+}
+
+func newPRTemplateData(prDetails PRDetails) PRTemplateData {
+	shortSHA := prDetails.HeadSHA
+	if len(shortSHA) > SHORT_SHA_LENGTH {
+		shortSHA = shortSHA[:SHORT_SHA_LENGTH]
+	}
+	return PRTemplateData{
+		Number:    prDetails.Number,
+		HeadSHA:   prDetails.HeadSHA,
+		ShortSHA:  shortSHA,
+		Branch:    prDetails.Branch,
+		Author:    prDetails.Author,
+		Labels:    prDetails.Labels,
+		TitleSlug: slugify(prDetails.Title),
+	}
+}
+
+// slugify converts the PR title to a lower case string which can be used in DNS names and resource names
+func slugify(title string) string {
+	slug := nonSlugChars.ReplaceAllString(strings.ToLower(title), "-")
+	if len(slug) > MAX_TITLE_SLUG_LENGTH {
+		slug = slug[:MAX_TITLE_SLUG_LENGTH]
+	}
+	return strings.Trim(slug, "-")
+}
+
+// renderValuesTemplate executes the values template with the PR metadata and parses the resulting YAML
+func renderValuesTemplate(valuesTemplate string, prDetails PRDetails) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if strings.TrimSpace(valuesTemplate) == "" {
+		return values, nil
+	}
+
+	tmpl, err := template.New("values").Option("missingkey=error").Parse(valuesTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse values template: %w", err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, newPRTemplateData(prDetails)); err != nil {
+		return nil, fmt.Errorf("unable to render values template: %w", err)
+	}
+
+	if err := yaml.Unmarshal(rendered.Bytes(), &values); err != nil {
+		return nil, fmt.Errorf("rendered values template is not valid YAML: %w", err)
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+// mergeValues merges src into dst recursively, values in src take precedence over values in dst
+func mergeValues(dst, src map[string]interface{}) map[string]interface{} {
+	for key, srcVal := range src {
+		srcMap, srcIsMap := srcVal.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			dst[key] = mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[key] = srcVal
+	}
+	return dst
+}
+
+// buildHelmReleaseValues returns the values for the PR HelmRelease. The static values are merged with the rendered
+// values template, and the prNumber and prSHA values used by the controller to track the release are always set.
+func buildHelmReleaseValues(helmRepo prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo, prDetails PRDetails) (*apiextensionsv1.JSON, error) {
+	values := map[string]interface{}{}
+
+	if helmRepo.Values != nil && len(helmRepo.Values.Raw) > 0 {
+		if err := json.Unmarshal(helmRepo.Values.Raw, &values); err != nil {
+			return nil, fmt.Errorf("static values are not a valid JSON object: %w", err)
+		}
+	}
+
+	templateValues, err := renderValuesTemplate(helmRepo.ValuesTemplate, prDetails)
+	if err != nil {
+		return nil, err
+	}
+	values = mergeValues(values, templateValues)
+
+	values["prNumber"] = prDetails.Number
+	values["prSHA"] = prDetails.HeadSHA
+
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return &apiextensionsv1.JSON{Raw: raw}, nil
+}
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+var testPRDetails = PRDetails{
+	Number:  42,
+	HeadSHA: "a1b2c3d4e5f6a7b8",
+	Title:   "Add the Checkout page!",
+	Branch:  "feature/checkout",
+	Author:  "octocat",
+	Labels:  []string{"preview", "large"},
+}
+
+func TestRenderValuesTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		expected map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "empty template", template: "  \n", expected: map[string]interface{}{}},
+		{name: "comment only", template: "# no values", expected: map[string]interface{}{}},
+		{
+			name:     "PR metadata",
+			template: "image:\n  tag: {{ .ShortSHA }}\nhost: pr-{{ .Number }}-{{ .TitleSlug }}.example.com\nbranch: {{ .Branch }}\nauthor: {{ .Author }}\nfirstLabel: {{ index .Labels 0 }}\nsha: {{ .HeadSHA }}",
+			expected: map[string]interface{}{
+				"image":      map[string]interface{}{"tag": "a1b2c3d"},
+				"host":       "pr-42-add-the-checkout-page.example.com",
+				"branch":     "feature/checkout",
+				"author":     "octocat",
+				"firstLabel": "preview",
+				"sha":        "a1b2c3d4e5f6a7b8",
+			},
+		},
+		{name: "unknown field", template: "value: {{ .Missing }}", wantErr: true},
+		{name: "invalid template", template: "value: {{ .Number", wantErr: true},
+		{name: "invalid YAML", template: "value: [{{ .Number }}", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values, err := renderValuesTemplate(tc.template, testPRDetails)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got values %v", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, values)
+			}
+		})
+	}
+}
+
+func TestMergeValues(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		dst      map[string]interface{}
+		src      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "nested maps are merged",
+			dst:      map[string]interface{}{"image": map[string]interface{}{"repository": "app", "tag": "latest"}},
+			src:      map[string]interface{}{"image": map[string]interface{}{"tag": "abc"}},
+			expected: map[string]interface{}{"image": map[string]interface{}{"repository": "app", "tag": "abc"}},
+		},
+		{
+			name:     "src takes precedence over a map",
+			dst:      map[string]interface{}{"ingress": map[string]interface{}{"enabled": true}},
+			src:      map[string]interface{}{"ingress": false},
+			expected: map[string]interface{}{"ingress": false},
+		},
+		{
+			name:     "lists are replaced",
+			dst:      map[string]interface{}{"hosts": []interface{}{"a", "b"}, "replicas": 1},
+			src:      map[string]interface{}{"hosts": []interface{}{"c"}},
+			expected: map[string]interface{}{"hosts": []interface{}{"c"}, "replicas": 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if merged := mergeValues(tc.dst, tc.src); !reflect.DeepEqual(merged, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, merged)
+			}
+		})
+	}
+}
+
+func TestBuildHelmReleaseValues(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		values         string
+		valuesTemplate string
+		expected       map[string]interface{}
+		wantErr        bool
+	}{
+		{
+			name:     "no values",
+			expected: map[string]interface{}{"prNumber": float64(42), "prSHA": "a1b2c3d4e5f6a7b8"},
+		},
+		{
+			name:           "template overrides static values",
+			values:         `{"image":{"repository":"app","tag":"latest"},"replicas":2}`,
+			valuesTemplate: "image:\n  tag: {{ .ShortSHA }}",
+			expected: map[string]interface{}{
+				"image":    map[string]interface{}{"repository": "app", "tag": "a1b2c3d"},
+				"replicas": float64(2),
+				"prNumber": float64(42),
+				"prSHA":    "a1b2c3d4e5f6a7b8",
+			},
+		},
+		{
+			name:           "prNumber and prSHA cannot be overridden",
+			values:         `{"prNumber":1}`,
+			valuesTemplate: "prSHA: other",
+			expected:       map[string]interface{}{"prNumber": float64(42), "prSHA": "a1b2c3d4e5f6a7b8"},
+		},
+		{name: "static values not an object", values: `["a"]`, wantErr: true},
+		{name: "invalid template", valuesTemplate: "value: {{ .Missing }}", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			helmRepo := prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{ValuesTemplate: tc.valuesTemplate}
+			if tc.values != "" {
+				helmRepo.Values = &apiextensionsv1.JSON{Raw: []byte(tc.values)}
+			}
+			raw, err := buildHelmReleaseValues(helmRepo, testPRDetails)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got values %s", raw.Raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := map[string]interface{}{}
+			if err := json.Unmarshal(raw.Raw, &values); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, values)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	// Embed the time zone database, as the controller image does not contain one
+	_ "time/tzdata"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"github.com/robfig/cron/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	HIBERNATED_VALUE               = "hibernated"
+	HIBERNATED_REPLICAS_ANNOTATION = "prephemeralenv.io/hibernated-replicas"
+	HELM_RELEASE_NAME_ANNOTATION   = "meta.helm.sh/release-name"
+	DEFAULT_WAKE_ON_COMMIT         = 2 * time.Hour
+)
+
+// Validates the time zone and the cron expressions of the active windows of the schedule
+func ValidateSchedule(schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule) error {
+	if schedule == nil {
+		return nil
+	}
+	if _, err := getScheduleLocation(schedule); err != nil {
+		return err
+	}
+	for _, window := range schedule.ActiveWindows {
+		if _, err := cron.ParseStandard(window.Start); err != nil {
+			return fmt.Errorf("invalid cron expression %q for active window: %w", window.Start, err)
+		}
+		if window.Duration.Duration <= 0 {
+			return fmt.Errorf("active window %q must have a positive duration", window.Start)
+		}
+	}
+	return nil
+}
+
+func getScheduleLocation(schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule) (*time.Location, error) {
+	if schedule.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", schedule.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// Checks if the time passed is within one of the active windows of the schedule. A window is active if it started
+// less than its duration ago.
+func isInActiveWindow(schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule, now time.Time) (bool, error) {
+	loc, err := getScheduleLocation(schedule)
+	if err != nil {
+		return false, err
+	}
+	now = now.In(loc)
+	for _, window := range schedule.ActiveWindows {
+		start, err := cron.ParseStandard(window.Start)
+		if err != nil {
+			return false, err
+		}
+		if !start.Next(now.Add(-window.Duration.Duration)).After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the time until which an environment stays awake after a new commit outside the active windows
+func getAwakeUntil(schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule, now metav1.Time) *metav1.Time {
+	wakeOnCommit := DEFAULT_WAKE_ON_COMMIT
+	if schedule.WakeOnCommitDuration != nil {
+		wakeOnCommit = schedule.WakeOnCommitDuration.Duration
+	}
+	awakeUntil := metav1.NewTime(now.Add(wakeOnCommit))
+	return &awakeUntil
+}
+
+// Checks if the environment of the PR should be hibernated, environments woken up by a new commit stay awake
+// until their awakeUntil time
+func shouldHibernate(schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, now metav1.Time) (bool, error) {
+	active, err := isInActiveWindow(schedule, now.Time)
+	if err != nil || active {
+		return false, err
+	}
+	if envStatus.AwakeUntil != nil && now.Before(envStatus.AwakeUntil) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Hibernates the environment of the PR. With the HibernatedValue mode, the hibernated value is set on the HelmRelease
+// and the HelmRelease is suspended once Flux has applied it. With the ScaleDown mode, the HelmRelease is suspended
+// and the Deployments and StatefulSets of the release are scaled to zero.
+func (r *PREphemeralEnvControllerReconciler) HibernateEnv(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	logger := log.FromContext(ctx)
+	schedule := prController.Spec.Schedule
+
+	if schedule.Mode == prcontrollerephemeralenviov1alpha1.HibernationModeScaleDown {
+		if !helmRel.Spec.Suspend {
+			helmRel.Spec.Suspend = true
+			if err := r.Client.Update(ctx, &helmRel); err != nil {
+				return err
+			}
+		}
+		if err := r.scaleReleaseWorkloads(ctx, helmRel, true); err != nil {
+			return err
+		}
+	} else {
+		hibernated, err := hasHibernatedValue(helmRel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !hibernated:
+			if err := setHibernatedValue(&helmRel); err != nil {
+				return err
+			}
+			if err := r.Client.Update(ctx, &helmRel); err != nil {
+				return err
+			}
+		case !helmRel.Spec.Suspend && !isHelmReleaseInProgress(helmRel):
+			// Flux has applied the hibernated value, suspend the HelmRelease until the environment wakes up
+			helmRel.Spec.Suspend = true
+			if err := r.Client.Update(ctx, &helmRel); err != nil {
+				return err
+			}
+		}
+	}
+
+	if envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated {
+		return nil
+	}
+	envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated
+	envStatus.AwakeUntil = nil
+	envStatus.Message = "Environment hibernated outside the active windows of the schedule"
+
+	mesg := fmt.Sprintf("Environment hibernated for PR %d", prDetails.Number)
+	r.Record.Event(prController, "Normal", "EnvHibernated", mesg)
+	logger.Info(mesg)
+	if err := r.UpdatePRStatus(ctx, prController, prDetails.Number, prDetails.HeadSHA, "success", "Environment hibernated outside active hours, push a commit to wake it up"); err != nil {
+		logger.Error(err, "unable to update PR status")
+	}
+	return nil
+}
+
+// Wakes up the hibernated environment of the PR. Workloads scaled down are scaled back up, and the HelmRelease is
+// updated with the generated spec, which resumes it and removes the hibernated value.
+func (r *PREphemeralEnvControllerReconciler) WakeEnv(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, targetNamespace string, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	logger := log.FromContext(ctx)
+
+	if err := r.scaleReleaseWorkloads(ctx, helmRel, false); err != nil {
+		return err
+	}
+	if err := r.UpdateFluxHelmRelease(ctx, prController, helmRel, prDetails, targetNamespace); err != nil {
+		return err
+	}
+
+	envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseActive
+	envStatus.Message = ""
+
+	mesg := fmt.Sprintf("Environment woken up for PR %d", prDetails.Number)
+	r.Record.Event(prController, "Normal", "EnvWokenUp", mesg)
+	logger.Info(mesg)
+
+	prStatus, description := "success", "Environment woken up from hibernation"
+	if len(getHealthChecks(prController.Spec)) > 0 || prController.Spec.SmokeTest != nil {
+		prStatus, description = "pending", "Waking up ephemeral environment for PR from hibernation"
+	}
+	if err := r.UpdatePRStatus(ctx, prController, prDetails.Number, prDetails.HeadSHA, prStatus, description); err != nil {
+		logger.Error(err, "unable to update PR status")
+	}
+	return nil
+}
+
+// Resumes the hibernated HelmRelease of a PR before it is deleted, as Flux does not uninstall suspended HelmReleases.
+// The hibernated value is removed and the workloads are scaled back up. Returns true once Flux has observed the
+// resumed HelmRelease, and it can be deleted
+func (r *PREphemeralEnvControllerReconciler) ResumeHibernatedHelmRelease(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus) (bool, error) {
+	hibernated, err := hasHibernatedValue(helmRel)
+	if err != nil {
+		return false, err
+	}
+	if !hibernated && !helmRel.Spec.Suspend && envStatus.Phase != prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated {
+		return true, nil
+	}
+
+	if hibernated || helmRel.Spec.Suspend {
+		if err := r.scaleReleaseWorkloads(ctx, helmRel, false); err != nil {
+			return false, err
+		}
+		if err := removeHibernatedValue(&helmRel); err != nil {
+			return false, err
+		}
+		helmRel.Spec.Suspend = false
+		if err := r.Client.Update(ctx, &helmRel); err != nil {
+			return false, err
+		}
+		envStatus.Message = "Resuming the hibernated environment before deleting it"
+		return false, nil
+	}
+	if helmRel.Status.ObservedGeneration != helmRel.Generation {
+		envStatus.Message = "Waiting for Flux to resume the hibernated environment before deleting it"
+		return false, nil
+	}
+	return true, nil
+}
+
+func hasHibernatedValue(helmRel fluxhelmrelease.HelmRelease) (bool, error) {
+	values := map[string]interface{}{}
+	if helmRel.Spec.Values == nil || len(helmRel.Spec.Values.Raw) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(helmRel.Spec.Values.Raw, &values); err != nil {
+		return false, err
+	}
+	hibernated, _ := values[HIBERNATED_VALUE].(bool)
+	return hibernated, nil
+}
+
+func setHibernatedValue(helmRel *fluxhelmrelease.HelmRelease) error {
+	values := map[string]interface{}{}
+	if helmRel.Spec.Values != nil && len(helmRel.Spec.Values.Raw) > 0 {
+		if err := json.Unmarshal(helmRel.Spec.Values.Raw, &values); err != nil {
+			return err
+		}
+	}
+	values[HIBERNATED_VALUE] = true
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	helmRel.Spec.Values = &apiextensionsv1.JSON{Raw: raw}
+	return nil
+}
+
+func removeHibernatedValue(helmRel *fluxhelmrelease.HelmRelease) error {
+	if helmRel.Spec.Values == nil || len(helmRel.Spec.Values.Raw) == 0 {
+		return nil
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(helmRel.Spec.Values.Raw, &values); err != nil {
+		return err
+	}
+	if _, ok := values[HIBERNATED_VALUE]; !ok {
+		return nil
+	}
+	delete(values, HIBERNATED_VALUE)
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	helmRel.Spec.Values = &apiextensionsv1.JSON{Raw: raw}
+	return nil
+}
+
+// Scales the Deployments and StatefulSets installed by the Helm release to zero, recording their replicas in an
+// annotation, or scales them back up to the recorded replicas
+func (r *PREphemeralEnvControllerReconciler) scaleReleaseWorkloads(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, scaleDown bool) error {
+	namespace := helmRel.Spec.TargetNamespace
+	if namespace == "" {
+		namespace = helmRel.Namespace
+	}
+	releaseName := helmRel.Spec.ReleaseName
+	if releaseName == "" {
+		releaseName = helmRel.Name
+	}
+
+	var deployments appsv1.DeploymentList
+	if err := r.List(ctx, &deployments, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if deployment.Annotations[HELM_RELEASE_NAME_ANNOTATION] != releaseName {
+			continue
+		}
+		if err := r.scaleWorkload(ctx, deployment, &deployment.Spec.Replicas, scaleDown); err != nil {
+			return err
+		}
+	}
+
+	var statefulSets appsv1.StatefulSetList
+	if err := r.List(ctx, &statefulSets, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		statefulSet := &statefulSets.Items[i]
+		if statefulSet.Annotations[HELM_RELEASE_NAME_ANNOTATION] != releaseName {
+			continue
+		}
+		if err := r.scaleWorkload(ctx, statefulSet, &statefulSet.Spec.Replicas, scaleDown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PREphemeralEnvControllerReconciler) scaleWorkload(ctx context.Context, workload client.Object, replicas **int32, scaleDown bool) error {
+	annotations := workload.GetAnnotations()
+	recorded, isHibernated := annotations[HIBERNATED_REPLICAS_ANNOTATION]
+
+	if scaleDown {
+		if isHibernated {
+			return nil
+		}
+		current := int32(1)
+		if *replicas != nil {
+			current = **replicas
+		}
+		annotations[HIBERNATED_REPLICAS_ANNOTATION] = strconv.Itoa(int(current))
+		zero := int32(0)
+		*replicas = &zero
+	} else {
+		if !isHibernated {
+			return nil
+		}
+		original, err := strconv.Atoi(recorded)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation on %s: %w", HIBERNATED_REPLICAS_ANNOTATION, workload.GetName(), err)
+		}
+		restored := int32(original)
+		*replicas = &restored
+		delete(annotations, HIBERNATED_REPLICAS_ANNOTATION)
+	}
+
+	workload.SetAnnotations(annotations)
+	return r.Client.Update(ctx, workload)
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestSchedule(timeZone string, windows ...prcontrollerephemeralenviov1alpha1.ActiveWindow) *prcontrollerephemeralenviov1alpha1.HibernationSchedule {
+	return &prcontrollerephemeralenviov1alpha1.HibernationSchedule{ActiveWindows: windows, TimeZone: timeZone}
+}
+
+func newTestWindow(start string, duration time.Duration) prcontrollerephemeralenviov1alpha1.ActiveWindow {
+	return prcontrollerephemeralenviov1alpha1.ActiveWindow{Start: start, Duration: metav1.Duration{Duration: duration}}
+}
+
+func TestIsInActiveWindow(t *testing.T) {
+	// Monday 3 October 2022, Berlin is at UTC+2
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2022, 10, 3, hour, minute, 0, 0, time.UTC)
+	}
+	workingHours := newTestWindow("0 8 * * 1-5", 11*time.Hour)
+	for _, tc := range []struct {
+		name     string
+		schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule
+		now      time.Time
+		expected bool
+	}{
+		{name: "before the window", schedule: newTestSchedule("", workingHours), now: monday(7, 59), expected: false},
+		{name: "start of the window", schedule: newTestSchedule("", workingHours), now: monday(8, 0), expected: true},
+		{name: "within the window", schedule: newTestSchedule("", workingHours), now: monday(18, 59), expected: true},
+		{name: "end of the window", schedule: newTestSchedule("", workingHours), now: monday(19, 0), expected: false},
+		{name: "weekend", schedule: newTestSchedule("", workingHours), now: time.Date(2022, 10, 2, 12, 0, 0, 0, time.UTC), expected: false},
+		{name: "time zone before the window", schedule: newTestSchedule("Europe/Berlin", workingHours), now: monday(5, 59), expected: false},
+		{name: "time zone within the window", schedule: newTestSchedule("Europe/Berlin", workingHours), now: monday(6, 0), expected: true},
+		{name: "time zone end of the window", schedule: newTestSchedule("Europe/Berlin", workingHours), now: monday(17, 0), expected: false},
+		{name: "window spanning midnight", schedule: newTestSchedule("", newTestWindow("0 22 * * *", 4*time.Hour)), now: monday(1, 30), expected: true},
+		{name: "second window", schedule: newTestSchedule("", workingHours, newTestWindow("0 20 * * *", time.Hour)), now: monday(20, 30), expected: true},
+		{name: "no windows", schedule: newTestSchedule(""), now: monday(12, 0), expected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			active, err := isInActiveWindow(tc.schedule, tc.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active != tc.expected {
+				t.Errorf("expected active %v at %s, got %v", tc.expected, tc.now, active)
+			}
+		})
+	}
+}
+
+func TestShouldHibernate(t *testing.T) {
+	schedule := newTestSchedule("", newTestWindow("0 8 * * *", 11*time.Hour))
+	night := metav1.NewTime(time.Date(2022, 10, 3, 22, 0, 0, 0, time.UTC))
+	day := metav1.NewTime(time.Date(2022, 10, 3, 12, 0, 0, 0, time.UTC))
+	for _, tc := range []struct {
+		name       string
+		now        metav1.Time
+		awakeUntil *metav1.Time
+		expected   bool
+	}{
+		{name: "active window", now: day, expected: false},
+		{name: "outside the active windows", now: night, expected: true},
+		{name: "woken up by a commit", now: night, awakeUntil: getAwakeUntil(schedule, night), expected: false},
+		{name: "awake time elapsed", now: night, awakeUntil: &day, expected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{AwakeUntil: tc.awakeUntil}
+			hibernate, err := shouldHibernate(schedule, envStatus, tc.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hibernate != tc.expected {
+				t.Errorf("expected hibernate %v, got %v", tc.expected, hibernate)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		schedule *prcontrollerephemeralenviov1alpha1.HibernationSchedule
+		wantErr  bool
+	}{
+		{name: "no schedule"},
+		{name: "valid", schedule: newTestSchedule("Europe/Berlin", newTestWindow("0 8 * * 1-5", 11*time.Hour))},
+		{name: "invalid time zone", schedule: newTestSchedule("Mars/Olympus", newTestWindow("0 8 * * 1-5", time.Hour)), wantErr: true},
+		{name: "invalid cron expression", schedule: newTestSchedule("", newTestWindow("0 25 * * *", time.Hour)), wantErr: true},
+		{name: "no duration", schedule: newTestSchedule("", newTestWindow("0 8 * * *", 0)), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateSchedule(tc.schedule); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDeleteHibernatedFluxHelmRelease(t *testing.T) {
+	ctx := context.Background()
+	closedAt := metav1.NewTime(time.Date(2022, 10, 7, 22, 0, 0, 0, time.UTC))
+	helmRel := fluxhelmrelease.HelmRelease{
+		ObjectMeta: metav1.ObjectMeta{Name: "relpr-42", Namespace: "envs", Generation: 4},
+		Spec: fluxhelmrelease.HelmReleaseSpec{
+			Suspend:         true,
+			TargetNamespace: "shop-pr-42",
+			Values:          &apiextensionsv1.JSON{Raw: []byte(`{"hibernated":true,"prNumber":"42"}`)},
+		},
+		Status: fluxhelmrelease.HelmReleaseStatus{ObservedGeneration: 4},
+	}
+	replicas := int32(0)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop-pr-42", Annotations: map[string]string{
+			HELM_RELEASE_NAME_ANNOTATION:   "relpr-42",
+			HIBERNATED_REPLICAS_ANNOTATION: "2",
+		}},
+		Spec: appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+	prController.Status.Environments = []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{{
+		PRNumber: 42,
+		Phase:    prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated,
+		ClosedAt: &closedAt,
+		Outcome:  prcontrollerephemeralenviov1alpha1.PROutcomeMerged,
+	}}
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(helmRel.DeepCopy(), deployment).Build(),
+		Record: record.NewFakeRecorder(10),
+	}
+	now := metav1.NewTime(closedAt.Add(time.Minute))
+	key := types.NamespacedName{Name: "relpr-42", Namespace: "envs"}
+
+	// The HelmRelease is resumed instead of being deleted
+	if err := r.Get(ctx, key, &helmRel); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteFluxHelmRelease(ctx, map[int]fluxhelmrelease.HelmRelease{42: helmRel}, map[int]PRDetails{}, prController, now); err != nil {
+		t.Fatal(err)
+	}
+	var resumed fluxhelmrelease.HelmRelease
+	if err := r.Get(ctx, key, &resumed); err != nil {
+		t.Fatalf("expected the hibernated HelmRelease to be kept until it is resumed, got %v", err)
+	}
+	if hibernated, _ := hasHibernatedValue(resumed); resumed.Spec.Suspend || hibernated {
+		t.Errorf("expected the HelmRelease to be resumed without the hibernated value, got suspend %v and values %s", resumed.Spec.Suspend, resumed.Spec.Values.Raw)
+	}
+	var scaledUp appsv1.Deployment
+	if err := r.Get(ctx, types.NamespacedName{Name: "web", Namespace: "shop-pr-42"}, &scaledUp); err != nil {
+		t.Fatal(err)
+	}
+	if scaledUp.Spec.Replicas == nil || *scaledUp.Spec.Replicas != 2 {
+		t.Errorf("expected the Deployment to be scaled back up to 2 replicas, got %v", scaledUp.Spec.Replicas)
+	}
+
+	// The HelmRelease is kept until Flux observed the resumed spec
+	resumed.Generation = 5
+	if err := r.DeleteFluxHelmRelease(ctx, map[int]fluxhelmrelease.HelmRelease{42: resumed}, map[int]PRDetails{}, prController, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &fluxhelmrelease.HelmRelease{}); err != nil {
+		t.Fatalf("expected the HelmRelease to be kept until Flux observed it, got %v", err)
+	}
+
+	resumed.Status.ObservedGeneration = 5
+	if err := r.DeleteFluxHelmRelease(ctx, map[int]fluxhelmrelease.HelmRelease{42: resumed}, map[int]PRDetails{}, prController, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &fluxhelmrelease.HelmRelease{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the resumed HelmRelease to be deleted, got %v", err)
+	}
+}
+
+func TestWakeEnvReportsPendingUntilReady(t *testing.T) {
+	github := &fakeGithub{}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	for _, tc := range []struct {
+		name      string
+		smokeTest *prcontrollerephemeralenviov1alpha1.HookJob
+		expected  string
+	}{
+		{name: "nothing to wait for", expected: "success"},
+		{name: "smoke test", smokeTest: &prcontrollerephemeralenviov1alpha1.HookJob{JobTemplate: seedJobTemplate}, expected: "pending"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prController, secret := newTestPRController("shop")
+			prController.Spec.SmokeTest = tc.smokeTest
+			prController.Status.Environments = []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{{PRNumber: 1, Phase: prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated}}
+			helmRel := &fluxhelmrelease.HelmRelease{
+				ObjectMeta: metav1.ObjectMeta{Name: "relpr-1", Namespace: "envs-shop"},
+				Spec:       fluxhelmrelease.HelmReleaseSpec{Suspend: true},
+			}
+			r := &PREphemeralEnvControllerReconciler{
+				Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(helmRel, secret).Build(),
+				Record: record.NewFakeRecorder(10),
+			}
+			ctx := WithGHRepo(context.Background(), GHRepo{User: "org", Repo: "shop", Token: "token-shop"})
+			if err := r.Get(ctx, types.NamespacedName{Name: "relpr-1", Namespace: "envs-shop"}, helmRel); err != nil {
+				t.Fatal(err)
+			}
+
+			envStatus := &prController.Status.Environments[0]
+			prDetails := PRDetails{Number: 1, HeadSHA: "sha-shop", Branch: "feature"}
+			if err := r.WakeEnv(ctx, *helmRel, prDetails, "", envStatus, prController); err != nil {
+				t.Fatal(err)
+			}
+			if len(envStatus.ReportedStatuses) != 1 || envStatus.ReportedStatuses[0].State != tc.expected {
+				t.Errorf("expected the %s PR status once woken up, got %+v", tc.expected, envStatus.ReportedStatuses)
+			}
+			if len(github.errors) > 0 {
+				t.Errorf("unexpected Github requests: %v", github.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	HOOK_LABEL           = "prephemeralenv.io/hook"
+	POST_CREATE_HOOK     = "post-create"
+	PRE_DELETE_HOOK      = "pre-delete"
+	DEFAULT_HOOK_TIMEOUT = 10 * time.Minute
+	HOOK_JOB_UID_LENGTH  = 8
+	// Time for which finished hook Jobs are kept, unless the Job template sets ttlSecondsAfterFinished
+	HOOK_JOB_TTL_SECONDS = int32(3600)
+	// Prefix of the Github status context the results of the postCreate and preDelete hooks are reported on
+	HOOK_STATUS_CONTEXT_PREFIX = "pr-ephemeral-env/hook-"
+)
+
+// Renders the Job template of the hook with the PR metadata, and parses the resulting YAML into a Job spec
+func renderHookJobSpec(hook *prcontrollerephemeralenviov1alpha1.HookJob, prDetails PRDetails) (batchv1.JobSpec, error) {
+	jobSpec := batchv1.JobSpec{}
+
+	tmpl, err := template.New("job").Option("missingkey=error").Parse(hook.JobTemplate)
+	if err != nil {
+		return jobSpec, fmt.Errorf("unable to parse job template: %w", err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, newPRTemplateData(prDetails)); err != nil {
+		return jobSpec, fmt.Errorf("unable to render job template: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(rendered.Bytes(), &jobSpec); err != nil {
+		return jobSpec, fmt.Errorf("rendered job template is not a valid Job spec: %w", err)
+	}
+	if jobSpec.Template.Spec.RestartPolicy == "" {
+		jobSpec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	return jobSpec, nil
+}
+
+// Validates that the Job templates of the hooks can be rendered
+func ValidateHooks(hooks *prcontrollerephemeralenviov1alpha1.Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	if hooks.PostCreate != nil {
+		if _, err := renderHookJobSpec(hooks.PostCreate, PRDetails{}); err != nil {
+			return fmt.Errorf("invalid postCreate hook: %w", err)
+		}
+	}
+	if hooks.PreDelete != nil {
+		if _, err := renderHookJobSpec(hooks.PreDelete, PRDetails{}); err != nil {
+			return fmt.Errorf("invalid preDelete hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns the name of the hook Job. The name includes the UID of the HelmRelease, so that an environment which is
+// recreated runs its hooks again, and the short PR head SHA if one is passed, so that the hook can run again for a
+// new commit
+func getHookJobName(helmRel fluxhelmrelease.HelmRelease, hookName string, prHeadSHA string) string {
+	uid := string(helmRel.UID)
+	if len(uid) > HOOK_JOB_UID_LENGTH {
+		uid = uid[:HOOK_JOB_UID_LENGTH]
+	}
+	name := fmt.Sprintf("%s-%s-%s", helmRel.Name, hookName, uid)
+	if len(prHeadSHA) > SHORT_SHA_LENGTH {
+		prHeadSHA = prHeadSHA[:SHORT_SHA_LENGTH]
+	}
+	if prHeadSHA != "" {
+		name = fmt.Sprintf("%s-%s", name, prHeadSHA)
+	}
+	return name
+}
+
+// Returns the timeout of the hook, measured from the first attempt to run it
+func getHookTimeout(hook *prcontrollerephemeralenviov1alpha1.HookJob) time.Duration {
+	if hook.Timeout != nil {
+		return hook.Timeout.Duration
+	}
+	return DEFAULT_HOOK_TIMEOUT
+}
+
+// Returns the result of the hook Job, Running is returned until the Job has finished or the hook timeout has passed
+// since the first attempt to run the hook
+func getHookJobResult(job *batchv1.Job, hook *prcontrollerephemeralenviov1alpha1.HookJob, startedAt metav1.Time, now metav1.Time) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return prcontrollerephemeralenviov1alpha1.HookResultSucceeded
+		case batchv1.JobFailed:
+			return prcontrollerephemeralenviov1alpha1.HookResultFailed
+		}
+	}
+
+	if now.Sub(startedAt.Time) > getHookTimeout(hook) {
+		return prcontrollerephemeralenviov1alpha1.HookResultTimedOut
+	}
+	return prcontrollerephemeralenviov1alpha1.HookResultRunning
+}
+
+// Returns the Github status context the hook is reported on. The smoke test decides if the environment is ready and
+// is reported on the default context, while the postCreate and preDelete hooks are reported on their own context
+func getHookStatusContext(hookName string) string {
+	if hookName == SMOKE_TEST_HOOK {
+		return ""
+	}
+	return HOOK_STATUS_CONTEXT_PREFIX + hookName
+}
+
+// Creates the hook Job with the name passed in the destination namespace, owned by the HelmRelease of the environment
+func (r *PREphemeralEnvControllerReconciler) createHookJob(ctx context.Context, hookName string, name string, hook *prcontrollerephemeralenviov1alpha1.HookJob, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	jobSpec, err := renderHookJobSpec(hook, prDetails)
+	if err != nil {
+		return err
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: prController.Spec.EnvCreationHelmRepo.DestinationNamespace,
+			Labels:    mergeLabels(getPRLabels(prController, prDetails.Number), map[string]string{HOOK_LABEL: hookName}),
+		},
+		Spec: jobSpec,
+	}
+	if job.Spec.TTLSecondsAfterFinished == nil {
+		ttl := HOOK_JOB_TTL_SECONDS
+		job.Spec.TTLSecondsAfterFinished = &ttl
+	}
+	if err := controllerutil.SetOwnerReference(&helmRel, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return fmt.Errorf("unable to create %s hook Job %s: %w", hookName, name, err)
+	}
+	return nil
+}
+
+// Runs the hook Job with the name passed for the environment of the PR in the destination namespace, creating the Job
+// if it does not exist yet, and returns the result of the hook. The timeout of the hook is measured from the time of
+// the first attempt passed, a Job which can not be created before the timeout has passed is reported as TimedOut.
+// Results are recorded as events and in the PR status on Github. Jobs are owned by the HelmRelease of the environment,
+// and are removed once their TTL has passed
+func (r *PREphemeralEnvControllerReconciler) RunHookJob(ctx context.Context, hookName string, name string, hook *prcontrollerephemeralenviov1alpha1.HookJob, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, startedAt metav1.Time, now metav1.Time) (string, error) {
+	logger := log.FromContext(ctx)
+	statusContext := getHookStatusContext(hookName)
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: prController.Spec.EnvCreationHelmRepo.DestinationNamespace, Name: name}, job)
+	if apierrors.IsNotFound(err) {
+		err = r.createHookJob(ctx, hookName, name, hook, helmRel, prDetails, prController)
+		if err == nil {
+			mesg := fmt.Sprintf("Started %s hook Job %s for PR %d", hookName, name, prDetails.Number)
+			r.Record.Event(prController, "Normal", "HookStarted", mesg)
+			logger.Info(mesg)
+			if err := r.UpdatePRStatusWithContext(ctx, prController, prDetails.Number, prDetails.HeadSHA, statusContext, "pending", fmt.Sprintf("Running %s hook", hookName)); err != nil {
+				logger.Error(err, "unable to update PR status")
+			}
+			return prcontrollerephemeralenviov1alpha1.HookResultRunning, nil
+		}
+	}
+
+	var result string
+	if err != nil {
+		// A hook which can not be run times out, so that it does not block the deletion of the environment
+		if now.Sub(startedAt.Time) <= getHookTimeout(hook) {
+			return "", err
+		}
+		logger.Error(err, fmt.Sprintf("unable to run the %s hook Job %s before the hook timed out", hookName, name))
+		result = prcontrollerephemeralenviov1alpha1.HookResultTimedOut
+	} else {
+		result = getHookJobResult(job, hook, startedAt, now)
+	}
+
+	prStatus, eventType := "failure", "Warning"
+	switch result {
+	case prcontrollerephemeralenviov1alpha1.HookResultRunning:
+		return result, nil
+	case prcontrollerephemeralenviov1alpha1.HookResultSucceeded:
+		prStatus, eventType = "success", "Normal"
+	}
+
+	mesg := fmt.Sprintf("The %s hook Job %s for PR %d finished with result %s", hookName, name, prDetails.Number, result)
+	r.Record.Event(prController, eventType, "Hook"+result, mesg)
+	logger.Info(mesg)
+	if err := r.UpdatePRStatusWithContext(ctx, prController, prDetails.Number, prDetails.HeadSHA, statusContext, prStatus, fmt.Sprintf("The %s hook %s", hookName, result)); err != nil {
+		logger.Error(err, "unable to update PR status")
+	}
+	return result, nil
+}
+
+// Deletes a hook Job which timed out, along with its Pods
+func (r *PREphemeralEnvControllerReconciler) deleteHookJob(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, name string) {
+	job := &batchv1.Job{}
+	job.Name = name
+	job.Namespace = prController.Spec.EnvCreationHelmRepo.DestinationNamespace
+	if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+		log.FromContext(ctx).Error(err, "unable to delete timed out hook Job", "job", name)
+	}
+}
+
+// Runs the postCreate hook once the HelmRelease of the environment is ready. Returns true once the hook succeeded,
+// or if no postCreate hook is configured. A hook which failed or timed out runs again for the next commit of the PR
+func (r *PREphemeralEnvControllerReconciler) RunPostCreateHook(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) bool {
+	logger := log.FromContext(ctx)
+
+	hooks := prController.Spec.Hooks
+	if hooks == nil || hooks.PostCreate == nil || envStatus.PostCreateHook == prcontrollerephemeralenviov1alpha1.HookResultSucceeded {
+		return true
+	}
+	if envStatus.PostCreateHook != "" && envStatus.PostCreateHook != prcontrollerephemeralenviov1alpha1.HookResultRunning {
+		return false
+	}
+	if !isHelmReleaseReady(helmRel) {
+		logger.Info("Waiting for the HelmRelease to be ready before running the postCreate hook", "prNumber", prDetails.Number)
+		return false
+	}
+
+	if envStatus.PostCreateHookStartedAt == nil {
+		envStatus.PostCreateHookStartedAt = &now
+	}
+	jobName := getHookJobName(helmRel, POST_CREATE_HOOK, prDetails.HeadSHA)
+	result, err := r.RunHookJob(ctx, POST_CREATE_HOOK, jobName, hooks.PostCreate, helmRel, prDetails, prController, *envStatus.PostCreateHookStartedAt, now)
+	if err != nil {
+		mesg := fmt.Sprintf("unable to run postCreate hook for PR %d", prDetails.Number)
+		r.Record.Event(prController, "Warning", "HookFailed", mesg)
+		logger.Error(err, mesg)
+		return false
+	}
+	envStatus.PostCreateHook = result
+	if result == prcontrollerephemeralenviov1alpha1.HookResultTimedOut {
+		r.deleteHookJob(ctx, prController, jobName)
+	}
+	return result == prcontrollerephemeralenviov1alpha1.HookResultSucceeded
+}
+
+// Runs the preDelete hook before the environment is deleted. Returns true once the hook has finished or timed out,
+// or if no preDelete hook is configured
+func (r *PREphemeralEnvControllerReconciler) RunPreDeleteHook(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) bool {
+	logger := log.FromContext(ctx)
+
+	hooks := prController.Spec.Hooks
+	if hooks == nil || hooks.PreDelete == nil {
+		return true
+	}
+	if envStatus.PreDeleteHook != "" && envStatus.PreDeleteHook != prcontrollerephemeralenviov1alpha1.HookResultRunning {
+		return true
+	}
+
+	if envStatus.PreDeleteHookStartedAt == nil {
+		envStatus.PreDeleteHookStartedAt = &now
+	}
+	jobName := getHookJobName(helmRel, PRE_DELETE_HOOK, "")
+	result, err := r.RunHookJob(ctx, PRE_DELETE_HOOK, jobName, hooks.PreDelete, helmRel, prDetails, prController, *envStatus.PreDeleteHookStartedAt, now)
+	if err != nil {
+		mesg := fmt.Sprintf("unable to run preDelete hook for PR %d", prDetails.Number)
+		r.Record.Event(prController, "Warning", "HookFailed", mesg)
+		logger.Error(err, mesg)
+		return false
+	}
+	envStatus.PreDeleteHook = result
+	if result == prcontrollerephemeralenviov1alpha1.HookResultTimedOut {
+		r.deleteHookJob(ctx, prController, jobName)
+	}
+	if result == prcontrollerephemeralenviov1alpha1.HookResultRunning {
+		envStatus.Message = "Waiting for the preDelete hook Job to finish before deleting the environment"
+		return false
+	}
+	return true
+}
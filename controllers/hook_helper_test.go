@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const seedJobTemplate = `
+backoffLimit: 1
+template:
+  spec:
+    containers:
+    - name: seed
+      image: ghcr.io/example/seed:{{ .ShortSHA }}
+      args: ["--pr", "{{ .Number }}", "--branch", "{{ .Branch }}"]
+`
+
+func TestRenderHookJobSpec(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		errorAt  string
+	}{
+		{name: "rendered", template: seedJobTemplate},
+		{name: "unknown PR field", template: `template: {spec: {containers: [{name: seed, image: "{{ .Sha }}"}]}}`, errorAt: "unable to render"},
+		{name: "invalid template", template: "{{ .Number", errorAt: "unable to parse"},
+		{name: "not a Job spec", template: "parallelism: many", errorAt: "not a valid Job spec"},
+		{name: "unknown Job field", template: "retries: 3", errorAt: "not a valid Job spec"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := &prcontrollerephemeralenviov1alpha1.HookJob{JobTemplate: tc.template}
+			jobSpec, err := renderHookJobSpec(hook, testPRDetails)
+			if tc.errorAt != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errorAt) {
+					t.Fatalf("expected an error about %s, got %v", tc.errorAt, err)
+				}
+				hooks := &prcontrollerephemeralenviov1alpha1.Hooks{PreDelete: hook}
+				if validateErr := ValidateHooks(hooks); validateErr == nil || !strings.Contains(validateErr.Error(), "preDelete") {
+					t.Errorf("expected the preDelete hook to be rejected, got %v", validateErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			container := jobSpec.Template.Spec.Containers[0]
+			if container.Image != "ghcr.io/example/seed:a1b2c3d" || strings.Join(container.Args, " ") != "--pr 42 --branch feature/checkout" {
+				t.Errorf("expected the PR metadata in the container, got image %s with args %v", container.Image, container.Args)
+			}
+			if jobSpec.Template.Spec.RestartPolicy != corev1.RestartPolicyNever {
+				t.Errorf("expected the restart policy to default to Never, got %s", jobSpec.Template.Spec.RestartPolicy)
+			}
+		})
+	}
+}
+
+func TestGetHookJobName(t *testing.T) {
+	helmRel := fluxhelmrelease.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "relpr-42", UID: types.UID("6f1c2a9e-93d4-4b0e-a1f7-0c5d3e2b8a41")}}
+	if name := getHookJobName(helmRel, PRE_DELETE_HOOK, ""); name != "relpr-42-pre-delete-6f1c2a9e" {
+		t.Errorf("expected the Job name to end with the start of the HelmRelease UID, got %s", name)
+	}
+	if name := getHookJobName(helmRel, POST_CREATE_HOOK, testPRDetails.HeadSHA); name != "relpr-42-post-create-6f1c2a9e-a1b2c3d" {
+		t.Errorf("expected the Job name to end with the short head SHA, got %s", name)
+	}
+	if getHookJobName(helmRel, POST_CREATE_HOOK, "9f8e7d6c5b4a3210") == getHookJobName(helmRel, POST_CREATE_HOOK, testPRDetails.HeadSHA) {
+		t.Error("expected a new commit to run the postCreate hook in a new Job")
+	}
+	recreated := helmRel
+	recreated.UID = types.UID("0d8e7f6a-1b2c-4d3e-9f80-7a6b5c4d3e2f")
+	if getHookJobName(recreated, PRE_DELETE_HOOK, "") == getHookJobName(helmRel, PRE_DELETE_HOOK, "") {
+		t.Error("expected a recreated HelmRelease to run its hooks in a new Job")
+	}
+}
+
+func TestGetHookJobResult(t *testing.T) {
+	startedAt := metav1.NewTime(time.Date(2022, 10, 5, 9, 0, 0, 0, time.UTC))
+	minutesLater := func(minutes int) metav1.Time {
+		return metav1.NewTime(startedAt.Add(time.Duration(minutes) * time.Minute))
+	}
+	finished := func(conditionType batchv1.JobConditionType, status corev1.ConditionStatus) []batchv1.JobCondition {
+		return []batchv1.JobCondition{{Type: conditionType, Status: status}}
+	}
+	for _, tc := range []struct {
+		name       string
+		conditions []batchv1.JobCondition
+		timeout    *metav1.Duration
+		created    metav1.Time
+		now        metav1.Time
+		expected   string
+	}{
+		{name: "running", now: minutesLater(3), expected: prcontrollerephemeralenviov1alpha1.HookResultRunning},
+		{name: "complete", conditions: finished(batchv1.JobComplete, corev1.ConditionTrue), now: minutesLater(3), expected: prcontrollerephemeralenviov1alpha1.HookResultSucceeded},
+		{name: "failed", conditions: finished(batchv1.JobFailed, corev1.ConditionTrue), now: minutesLater(3), expected: prcontrollerephemeralenviov1alpha1.HookResultFailed},
+		{name: "condition not true yet", conditions: finished(batchv1.JobComplete, corev1.ConditionFalse), now: minutesLater(3), expected: prcontrollerephemeralenviov1alpha1.HookResultRunning},
+		{name: "default timeout", now: minutesLater(11), expected: prcontrollerephemeralenviov1alpha1.HookResultTimedOut},
+		{name: "timeout since the first attempt", created: minutesLater(8), now: minutesLater(11), expected: prcontrollerephemeralenviov1alpha1.HookResultTimedOut},
+		{name: "custom timeout", timeout: &metav1.Duration{Duration: 30 * time.Minute}, now: minutesLater(11), expected: prcontrollerephemeralenviov1alpha1.HookResultRunning},
+		{name: "finished after the timeout", conditions: finished(batchv1.JobComplete, corev1.ConditionTrue), now: minutesLater(60), expected: prcontrollerephemeralenviov1alpha1.HookResultSucceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			created := tc.created
+			if created.IsZero() {
+				created = startedAt
+			}
+			job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: created}, Status: batchv1.JobStatus{Conditions: tc.conditions}}
+			hook := &prcontrollerephemeralenviov1alpha1.HookJob{Timeout: tc.timeout}
+			if result := getHookJobResult(job, hook, startedAt, tc.now); result != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestRunHookJob(t *testing.T) {
+	type postedStatus struct {
+		Context string `json:"context"`
+		State   string `json:"state"`
+	}
+	statuses := make(chan postedStatus, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var status postedStatus
+		_ = json.NewDecoder(req.Body).Decode(&status)
+		statuses <- status
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	startedAt := metav1.NewTime(time.Date(2022, 10, 5, 9, 0, 0, 0, time.UTC))
+	helmRel := fluxhelmrelease.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "relpr-42", Namespace: "envs"}}
+	completed := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "relpr-42-pre-delete", Namespace: "envs", CreationTimestamp: startedAt},
+		Status:     batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		existing []client.Object
+		now      metav1.Time
+		expected string
+		wantErr  bool
+		status   string
+	}{
+		{name: "finished", existing: []client.Object{completed}, now: metav1.NewTime(startedAt.Add(time.Minute)), expected: prcontrollerephemeralenviov1alpha1.HookResultSucceeded, status: "success"},
+		{name: "not created before the timeout", now: metav1.NewTime(startedAt.Add(time.Minute)), wantErr: true},
+		{name: "not created after the timeout", now: metav1.NewTime(startedAt.Add(11 * time.Minute)), expected: prcontrollerephemeralenviov1alpha1.HookResultTimedOut, status: "failure"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+			prController.Spec.EnvCreationHelmRepo = &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{DestinationNamespace: "envs"}
+			// The HelmRelease kind is missing from the scheme, so the Job can not be owned by the HelmRelease and created
+			r := &PREphemeralEnvControllerReconciler{
+				Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(tc.existing...).Build(),
+				Scheme: clientgoscheme.Scheme,
+				Record: record.NewFakeRecorder(10),
+			}
+			ctx := WithGHRepo(context.Background(), GHRepo{User: "org", Repo: "shop", Token: "token-shop"})
+			hook := &prcontrollerephemeralenviov1alpha1.HookJob{JobTemplate: seedJobTemplate}
+
+			result, err := r.RunHookJob(ctx, PRE_DELETE_HOOK, "relpr-42-pre-delete", hook, helmRel, testPRDetails, prController, startedAt, tc.now)
+			if (err != nil) != tc.wantErr || result != tc.expected {
+				t.Fatalf("expected the result %q with error %v, got %q with %v", tc.expected, tc.wantErr, result, err)
+			}
+			if tc.status == "" {
+				return
+			}
+			status := <-statuses
+			if status.Context != "pr-ephemeral-env/hook-pre-delete" || status.State != tc.status {
+				t.Errorf("expected the %s status on the context of the hook, got %+v", tc.status, status)
+			}
+		})
+	}
+}
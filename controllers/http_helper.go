@@ -1,18 +1,221 @@
 package controllers
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	DEFAULT_PROBE_TIMEOUT = 2 * time.Second
+	MAX_PROBE_BODY_SIZE   = 1 << 20
 )
 
-func IsEnvReady(ephEnvUrl string) bool {
-	client := http.Client{
-		Timeout: 2 * time.Second,
+// ProbeResult is the result of a single health check probe
+type ProbeResult struct {
+	Success    bool
+	StatusCode int
+	Message    string
+}
+
+// Probes the target with the probe type of the health check. The target is the URL template of the health check with
+// the PR placeholders replaced, or the address of its Service. http probes are sent with the HTTP client passed, or
+// with the default client if it is nil
+func Probe(ctx context.Context, healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, target string, bearerToken string, httpClient *http.Client) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, getProbeTimeout(healthCheck))
+	defer cancel()
+
+	switch healthCheck.Type {
+	case prcontrollerephemeralenviov1alpha1.ProbeTypeTCP:
+		return ProbeTCP(ctx, target)
+	case prcontrollerephemeralenviov1alpha1.ProbeTypeGRPC:
+		return ProbeGRPC(ctx, healthCheck, target, bearerToken)
+	case prcontrollerephemeralenviov1alpha1.ProbeTypeDNS:
+		return ProbeDNS(ctx, target)
+	default:
+		return ProbeHTTP(ctx, healthCheck, target, bearerToken, httpClient)
+	}
+}
+
+func getProbeTimeout(healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck) time.Duration {
+	if healthCheck.Timeout != nil && healthCheck.Timeout.Duration > 0 {
+		return healthCheck.Timeout.Duration
+	}
+	return DEFAULT_PROBE_TIMEOUT
+}
+
+// Returns the host:port address of the target. Targets can be URLs, in which case the port defaults to the port of
+// the URL scheme, or host:port addresses
+func getProbeAddress(target string) (string, error) {
+	if !strings.Contains(target, "://") {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "", fmt.Errorf("invalid address %q: %w", target, err)
+		}
+		return target, nil
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", target, err)
+	}
+	port := targetURL.Port()
+	if port == "" {
+		port = "80"
+		if targetURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(targetURL.Hostname(), port), nil
+}
+
+// Returns the host name of the target, which can be a URL, a host:port address or a host name
+func getProbeHost(target string) string {
+	if strings.Contains(target, "://") {
+		if targetURL, err := url.Parse(target); err == nil {
+			return targetURL.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// Probes the address by opening a TCP connection to it
+func ProbeTCP(ctx context.Context, target string) ProbeResult {
+	address, err := getProbeAddress(target)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
+	}
+	conn.Close()
+	return ProbeResult{Success: true}
+}
+
+// Probes the address with the standard gRPC health checking protocol, the probe succeeds if the service is serving.
+// The headers and bearer token of the health check are sent as metadata
+func ProbeGRPC(ctx context.Context, healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, target string, bearerToken string) ProbeResult {
+	address, err := getProbeAddress(target)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
+	}
+
+	transportCredentials := insecure.NewCredentials()
+	if healthCheck.TLS {
+		transportCredentials = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
 	}
-	resp, err := client.Get(ephEnvUrl)
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(transportCredentials), grpc.WithBlock())
 	if err != nil {
-		return false
+		return ProbeResult{Message: fmt.Sprintf("unable to connect: %v", err)}
+	}
+	defer conn.Close()
+
+	md := metadata.New(healthCheck.Headers)
+	if bearerToken != "" {
+		md.Set("authorization", "Bearer "+bearerToken)
+	}
+	resp, err := healthpb.NewHealthClient(conn).Check(metadata.NewOutgoingContext(ctx, md), &healthpb.HealthCheckRequest{Service: healthCheck.GRPCService})
+	if err != nil {
+		return ProbeResult{Message: fmt.Sprintf("health check failed: %v", err)}
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return ProbeResult{Message: fmt.Sprintf("service is %s", resp.GetStatus())}
+	}
+	return ProbeResult{Success: true}
+}
+
+// Probes the host name of the target by resolving it, the probe succeeds once the DNS record has propagated
+func ProbeDNS(ctx context.Context, target string) ProbeResult {
+	host := getProbeHost(target)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
+	}
+	if len(addrs) == 0 {
+		return ProbeResult{Message: fmt.Sprintf("no addresses found for %s", host)}
+	}
+	return ProbeResult{Success: true}
+}
+
+// Probes the URL with the method, headers and bearer token of the health check. The probe succeeds if the response
+// has one of the accepted status codes, and its body matches the body regex if one is configured
+func ProbeHTTP(ctx context.Context, healthCheck *prcontrollerephemeralenviov1alpha1.HealthCheck, url string, bearerToken string, httpClient *http.Client) ProbeResult {
+	method := healthCheck.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return ProbeResult{Message: fmt.Sprintf("invalid request: %v", err)}
+	}
+	for key, value := range healthCheck.Headers {
+		req.Header.Set(key, value)
+	}
+	if bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ProbeResult{Message: err.Error()}
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode == 200
+
+	result := ProbeResult{StatusCode: resp.StatusCode}
+	if !isAcceptedStatusCode(healthCheck.AcceptedStatusCodes, resp.StatusCode) {
+		result.Message = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+		return result
+	}
+
+	if healthCheck.BodyRegex != "" {
+		bodyRegex, err := regexp.Compile(healthCheck.BodyRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("invalid body regex: %v", err)
+			return result
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_PROBE_BODY_SIZE))
+		if err != nil {
+			result.Message = fmt.Sprintf("unable to read response body: %v", err)
+			return result
+		}
+		if !bodyRegex.Match(body) {
+			result.Message = "response body does not match the body regex"
+			return result
+		}
+	}
+
+	result.Success = true
+	return result
+}
+
+func isAcceptedStatusCode(acceptedStatusCodes []int, statusCode int) bool {
+	if len(acceptedStatusCodes) == 0 {
+		return statusCode == http.StatusOK
+	}
+	for _, accepted := range acceptedStatusCodes {
+		if accepted == statusCode {
+			return true
+		}
+	}
+	return false
 }
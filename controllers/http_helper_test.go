@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Serves /status/<code> with the status code in the path, and /slow after a delay. The body echoes the method,
+// the X-Env header and the Authorization header of the request
+func newProbeTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+			}
+		case req.URL.Path == "/status/204":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case req.URL.Path == "/status/503":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = io.WriteString(w, req.Method+" env="+req.Header.Get("X-Env")+" auth="+req.Header.Get("Authorization"))
+	}))
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := newProbeTestServer()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name        string
+		healthCheck prcontrollerephemeralenviov1alpha1.HealthCheck
+		path        string
+		bearerToken string
+		success     bool
+		statusCode  int
+		message     string
+	}{
+		{name: "ok", path: "/", success: true, statusCode: http.StatusOK},
+		{name: "unexpected status code", path: "/status/503", statusCode: http.StatusServiceUnavailable, message: "unexpected status code 503"},
+		{name: "only 200 accepted by default", path: "/status/204", statusCode: http.StatusNoContent, message: "unexpected status code 204"},
+		{
+			name:        "accepted status codes",
+			healthCheck: prcontrollerephemeralenviov1alpha1.HealthCheck{AcceptedStatusCodes: []int{http.StatusNoContent, http.StatusServiceUnavailable}},
+			path:        "/status/503",
+			success:     true,
+			statusCode:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "method, headers and bearer token",
+			healthCheck: prcontrollerephemeralenviov1alpha1.HealthCheck{Method: http.MethodPost, Headers: map[string]string{"X-Env": "pr-1"}, BodyRegex: `^POST env=pr-1 auth=Bearer secret$`},
+			path:        "/",
+			bearerToken: "secret",
+			success:     true,
+			statusCode:  http.StatusOK,
+		},
+		{name: "body regex mismatch", healthCheck: prcontrollerephemeralenviov1alpha1.HealthCheck{BodyRegex: "^POST"}, path: "/", statusCode: http.StatusOK, message: "does not match the body regex"},
+		{name: "invalid body regex", healthCheck: prcontrollerephemeralenviov1alpha1.HealthCheck{BodyRegex: "("}, path: "/", statusCode: http.StatusOK, message: "invalid body regex"},
+		{name: "timeout", healthCheck: prcontrollerephemeralenviov1alpha1.HealthCheck{Timeout: &metav1.Duration{Duration: 50 * time.Millisecond}}, path: "/slow", message: "deadline exceeded"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			healthCheck := tc.healthCheck
+			result := Probe(context.Background(), &healthCheck, server.URL+tc.path, tc.bearerToken, nil)
+			if result.Success != tc.success || result.StatusCode != tc.statusCode {
+				t.Errorf("expected success %v with status code %d, got %+v", tc.success, tc.statusCode, result)
+			}
+			if !strings.Contains(result.Message, tc.message) {
+				t.Errorf("expected the message to contain %q, got %q", tc.message, result.Message)
+			}
+		})
+	}
+}
+
+func TestGetProbeAddress(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		address  string
+		host     string
+		hasError bool
+	}{
+		{target: "http://app.pr-1.example.com/healthz", address: "app.pr-1.example.com:80", host: "app.pr-1.example.com"},
+		{target: "https://app.pr-1.example.com", address: "app.pr-1.example.com:443", host: "app.pr-1.example.com"},
+		{target: "grpc://app:9090", address: "app:9090", host: "app"},
+		{target: "app.envs.svc:5432", address: "app.envs.svc:5432", host: "app.envs.svc"},
+		{target: "app.envs.svc", host: "app.envs.svc", hasError: true},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			address, err := getProbeAddress(tc.target)
+			if (err != nil) != tc.hasError || address != tc.address {
+				t.Errorf("expected address %q with error %v, got %q with %v", tc.address, tc.hasError, address, err)
+			}
+			if host := getProbeHost(tc.target); host != tc.host {
+				t.Errorf("expected host %q, got %q", tc.host, host)
+			}
+		})
+	}
+}
+
+// Returns the address of a port nothing listens on
+func getClosedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, tc := range []struct {
+		name    string
+		target  string
+		success bool
+	}{
+		{name: "listening", target: listener.Addr().String(), success: true},
+		{name: "listening URL", target: "tcp://" + listener.Addr().String(), success: true},
+		{name: "closed port", target: getClosedAddress(t)},
+		{name: "invalid address", target: "127.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			healthCheck := &prcontrollerephemeralenviov1alpha1.HealthCheck{Type: prcontrollerephemeralenviov1alpha1.ProbeTypeTCP}
+			if result := Probe(context.Background(), healthCheck, tc.target, "", nil); result.Success != tc.success {
+				t.Errorf("expected success %v, got %+v", tc.success, result)
+			}
+		})
+	}
+}
+
+func TestProbeGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var authorization []string
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		authorization = append(authorization, md.Get("authorization")...)
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("app", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("down", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	for _, tc := range []struct {
+		name        string
+		target      string
+		service     string
+		bearerToken string
+		success     bool
+		message     string
+	}{
+		{name: "overall server health", target: listener.Addr().String(), success: true},
+		{name: "serving service", target: "grpc://" + listener.Addr().String(), service: "app", bearerToken: "secret", success: true},
+		{name: "not serving service", target: listener.Addr().String(), service: "down", message: "NOT_SERVING"},
+		{name: "unknown service", target: listener.Addr().String(), service: "unknown", message: "health check failed"},
+		{name: "closed port", target: getClosedAddress(t), message: "unable to connect"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			healthCheck := &prcontrollerephemeralenviov1alpha1.HealthCheck{
+				Type:        prcontrollerephemeralenviov1alpha1.ProbeTypeGRPC,
+				GRPCService: tc.service,
+				Timeout:     &metav1.Duration{Duration: 500 * time.Millisecond},
+			}
+			result := Probe(context.Background(), healthCheck, tc.target, tc.bearerToken, nil)
+			if result.Success != tc.success || !strings.Contains(result.Message, tc.message) {
+				t.Errorf("expected success %v with message %q, got %+v", tc.success, tc.message, result)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authorization) != 1 || authorization[0] != "Bearer secret" {
+		t.Errorf("expected the bearer token to be sent once as metadata, got %v", authorization)
+	}
+}
+
+func TestProbeDNS(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		target  string
+		success bool
+	}{
+		{name: "resolvable host", target: "localhost", success: true},
+		{name: "resolvable URL", target: "http://localhost:8080/healthz", success: true},
+		{name: "unresolvable host", target: "pr-1.example.invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			healthCheck := &prcontrollerephemeralenviov1alpha1.HealthCheck{Type: prcontrollerephemeralenviov1alpha1.ProbeTypeDNS}
+			if result := Probe(context.Background(), healthCheck, tc.target, "", nil); result.Success != tc.success {
+				t.Errorf("expected success %v, got %+v", tc.success, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const METRICS_NAMESPACE = "prephemeralenv"
+
+// Operations on the environments of the PRs, used as the operation label of the metrics
+const (
+	ENV_OPERATION_CREATE = "create"
+	ENV_OPERATION_UPDATE = "update"
+	ENV_OPERATION_DELETE = "delete"
+)
+
+// Phases reported by the environments metric, an environment without a phase is counted as Active
+var envMetricPhases = []string{
+	prcontrollerephemeralenviov1alpha1.EnvPhaseActive,
+	prcontrollerephemeralenviov1alpha1.EnvPhaseQueued,
+	prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated,
+	prcontrollerephemeralenviov1alpha1.EnvPhaseFailed,
+	prcontrollerephemeralenviov1alpha1.EnvPhaseExpired,
+}
+
+var (
+	environmentsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "environments",
+		Help:      "Number of PR environments of each PREphemeralEnvController, by phase",
+	}, []string{"namespace", "controller", "phase"})
+
+	envOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "environment_operations_total",
+		Help:      "Number of PR environments created, updated and deleted, by result",
+	}, []string{"namespace", "controller", "operation", "result"})
+
+	envReadySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "environment_ready_seconds",
+		Help:      "Time from the PR being opened to its environment being ready",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 10),
+	}, []string{"namespace", "controller"})
+
+	githubRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "github_requests_total",
+		Help:      "Number of Github API requests, by operation and status code",
+	}, []string{"operation", "code"})
+
+	githubRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "github_request_duration_seconds",
+		Help:      "Latency of the Github API requests, by operation",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	githubRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Number of Github API requests remaining in the current rate limit window, by token Secret",
+	}, []string{"token_secret"})
+
+	healthProbesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "health_probes_total",
+		Help:      "Number of health probes of the PR environments, by health check and result",
+	}, []string{"namespace", "controller", "health_check", "result"})
+
+	healthProbeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "health_probe_duration_seconds",
+		Help:      "Latency of the health probes of the PR environments, by health check",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "controller", "health_check"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		environmentsGauge,
+		envOperationsTotal,
+		envReadySeconds,
+		githubRequestsTotal,
+		githubRequestSeconds,
+		githubRateLimitRemaining,
+		healthProbesTotal,
+		healthProbeSeconds,
+	)
+}
+
+func getResultLabel(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// Records the number of environments of the controller in each phase
+func recordEnvironments(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) {
+	counts := map[string]int{}
+	for _, envStatus := range prController.Status.Environments {
+		phase := envStatus.Phase
+		if phase == "" {
+			phase = prcontrollerephemeralenviov1alpha1.EnvPhaseActive
+		}
+		counts[phase]++
+	}
+	for _, phase := range envMetricPhases {
+		environmentsGauge.WithLabelValues(prController.Namespace, prController.Name, phase).Set(float64(counts[phase]))
+	}
+}
+
+// Removes the metrics of a controller which was deleted
+func forgetEnvironments(owner types.NamespacedName) {
+	for _, phase := range envMetricPhases {
+		environmentsGauge.DeleteLabelValues(owner.Namespace, owner.Name, phase)
+	}
+}
+
+// Records the result of creating, updating or deleting the environment of a PR
+func recordEnvOperation(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, operation string, err error) {
+	envOperationsTotal.WithLabelValues(prController.Namespace, prController.Name, operation, getResultLabel(err == nil)).Inc()
+}
+
+// Records the time from the PR being opened to its environment being ready
+func recordEnvReady(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prDetails PRDetails, now time.Time) {
+	if prDetails.CreatedAt.IsZero() {
+		return
+	}
+	envReadySeconds.WithLabelValues(prController.Namespace, prController.Name).Observe(now.Sub(prDetails.CreatedAt).Seconds())
+}
+
+// Records a Github API request, along with the remaining rate limit returned by Github for the token of the
+// repository, as each token has its own rate limit. Tokens are identified by the namespace/name/key of their Secret
+func recordGHRequest(ghRepo GHRepo, operation string, start time.Time, resp *github.Response, err error) {
+	code := "error"
+	if resp != nil && resp.Response != nil {
+		code = strconv.Itoa(resp.StatusCode)
+		if resp.Rate.Limit > 0 {
+			githubRateLimitRemaining.WithLabelValues(ghRepo.TokenSecret).Set(float64(resp.Rate.Remaining))
+		}
+	} else if err == nil {
+		code = "ok"
+	}
+	githubRequestsTotal.WithLabelValues(operation, code).Inc()
+	githubRequestSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Records the result and latency of a health probe
+func recordHealthProbe(key ProbeKey, result ProbeResult, duration time.Duration) {
+	healthProbesTotal.WithLabelValues(key.Owner.Namespace, key.Owner.Name, key.Name, getResultLabel(result.Success)).Inc()
+	healthProbeSeconds.WithLabelValues(key.Owner.Namespace, key.Owner.Name, key.Name).Observe(duration.Seconds())
+}
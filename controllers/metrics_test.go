@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The remaining rate limit is reported for each token, as each token has its own rate limit
+func TestRecordGHRequestRateLimit(t *testing.T) {
+	app := GHRepo{User: "org", Repo: "app", Token: "token-app", TokenSecret: "default/gh-app/token"}
+	other := GHRepo{User: "org", Repo: "other", Token: "token-other", TokenSecret: "ci/gh-other/token"}
+	newResponse := func(remaining int) *github.Response {
+		return &github.Response{
+			Response: &http.Response{StatusCode: http.StatusOK},
+			Rate:     github.Rate{Limit: 5000, Remaining: remaining},
+		}
+	}
+
+	recordGHRequest(app, "list_pull_requests", time.Now(), newResponse(4000), nil)
+	recordGHRequest(other, "list_pull_requests", time.Now(), newResponse(120), nil)
+	// Responses without a rate limit, like errors before reaching Github, leave the gauge untouched
+	recordGHRequest(app, "create_status", time.Now(), nil, http.ErrHandlerTimeout)
+
+	for _, tc := range []struct {
+		ghRepo   GHRepo
+		expected float64
+	}{
+		{ghRepo: app, expected: 4000},
+		{ghRepo: other, expected: 120},
+	} {
+		if remaining := testutil.ToFloat64(githubRateLimitRemaining.WithLabelValues(tc.ghRepo.TokenSecret)); remaining != tc.expected {
+			t.Errorf("expected %v remaining requests for %s, got %v", tc.expected, tc.ghRepo.TokenSecret, remaining)
+		}
+	}
+}
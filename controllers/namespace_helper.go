@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	PR_NUMBER_LABEL            = "prephemeralenv.io/pr-number"
+	CONTROLLER_NAME_LABEL      = "prephemeralenv.io/controller-name"
+	CONTROLLER_NAMESPACE_LABEL = "prephemeralenv.io/controller-namespace"
+	PR_NAMESPACE_OBJECT_NAME   = "pr-ephemeral-env"
+	DEFAULT_NAMESPACE_TEMPLATE = "pr-<<PR_NUMBER>>"
+	PR_NUMBER_PLACEHOLDER      = "<<PR_NUMBER>>"
+	PR_HEAD_SHA_PLACEHOLDER    = "<<PR_HEAD_SHA>>"
+)
+
+// Returned when the namespace of a PR already exists and was not created by the controller
+var errPRNamespaceConflict = errors.New("namespace already exists and is not owned by the controller")
+
+// ClusterRoles which can be bound in the PR namespaces by default. The controller is only granted the bind verb on
+// these ClusterRoles, in config/rbac/role.yaml
+var DEFAULT_BINDABLE_CLUSTER_ROLES = []string{"view", "edit"}
+
+// Returns the labels identifying objects created by the controller for the PR
+func getPRLabels(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int) map[string]string {
+	return map[string]string{
+		MANAGED_BY_LABEL:           MANAGED_BY_VALUE,
+		CONTROLLER_NAME_LABEL:      prController.Name,
+		CONTROLLER_NAMESPACE_LABEL: prController.Namespace,
+		PR_NUMBER_LABEL:            strconv.Itoa(prNumber),
+	}
+}
+
+// Validates the namespace per PR configuration. The name template must contain <<PR_NUMBER>>, so that PRs do not share
+// a namespace, and must not contain <<PR_HEAD_SHA>>, as every push would then create a new namespace, while namespaces
+// are only deleted once the PR is closed. RoleBindings may only bind the ClusterRoles passed, which the controller is
+// allowed to bind
+func ValidatePRNamespace(prNamespace *prcontrollerephemeralenviov1alpha1.PRNamespace, bindableClusterRoles []string) error {
+	if prNamespace == nil {
+		return nil
+	}
+	if err := validatePRNamespaceNameTemplate(prNamespace.NameTemplate); err != nil {
+		return err
+	}
+	for _, rb := range prNamespace.RoleBindings {
+		if !isBindableRole(rb.RoleRef, bindableClusterRoles) {
+			return fmt.Errorf("roleBinding %s binds %s %s, only the ClusterRoles %s can be bound", rb.Name, rb.RoleRef.Kind, rb.RoleRef.Name, strings.Join(bindableClusterRoles, ", "))
+		}
+	}
+	return nil
+}
+
+func validatePRNamespaceNameTemplate(nameTemplate string) error {
+	if nameTemplate != "" && !strings.Contains(nameTemplate, PR_NUMBER_PLACEHOLDER) {
+		return fmt.Errorf("nameTemplate must contain %s, each PR must have its own namespace", PR_NUMBER_PLACEHOLDER)
+	}
+	if strings.Contains(nameTemplate, PR_HEAD_SHA_PLACEHOLDER) {
+		return fmt.Errorf("nameTemplate must not contain %s, the namespace of a PR must be the same for all its commits", PR_HEAD_SHA_PLACEHOLDER)
+	}
+	return nil
+}
+
+func isBindableRole(roleRef rbacv1.RoleRef, bindableClusterRoles []string) bool {
+	if roleRef.APIGroup != rbacv1.GroupName || roleRef.Kind != "ClusterRole" {
+		return false
+	}
+	for _, name := range bindableClusterRoles {
+		if roleRef.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the namespace for the PR, or an empty string if namespace per PR is not configured
+func getPRNamespaceName(prNamespace *prcontrollerephemeralenviov1alpha1.PRNamespace, prDetails PRDetails) (string, error) {
+	if prNamespace == nil {
+		return "", nil
+	}
+	nameTemplate := prNamespace.NameTemplate
+	if nameTemplate == "" {
+		nameTemplate = DEFAULT_NAMESPACE_TEMPLATE
+	}
+	if err := validatePRNamespaceNameTemplate(nameTemplate); err != nil {
+		return "", err
+	}
+	name := replacePRPlaceholders(nameTemplate, prDetails.Number, prDetails.HeadSHA)
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid namespace name %q for PR %d: %v", name, prDetails.Number, errs)
+	}
+	return name, nil
+}
+
+// Creates or updates the namespace for the PR, along with the ResourceQuota, LimitRange, NetworkPolicy and RoleBindings
+// configured in the CRD. The name of the namespace is returned, or an empty string if namespace per PR is not configured.
+// An existing namespace which was not created by the controller is not adopted, and errPRNamespaceConflict is returned
+func (r *PREphemeralEnvControllerReconciler) EnsurePRNamespace(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prDetails PRDetails) (string, error) {
+	logger := log.FromContext(ctx)
+	prNamespace := prController.Spec.PRNamespace
+
+	name, err := getPRNamespaceName(prNamespace, prDetails)
+	if err != nil || name == "" {
+		return name, err
+	}
+
+	labels := getPRLabels(prController, prDetails.Number)
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, namespace, func() error {
+		if namespace.ResourceVersion != "" && !isOwnedByController(namespace, prController) {
+			return errPRNamespaceConflict
+		}
+		namespace.Labels = mergeLabels(namespace.Labels, prNamespace.Labels, labels)
+		return nil
+	})
+	if errors.Is(err, errPRNamespaceConflict) {
+		return name, fmt.Errorf("namespace %s: %w", name, err)
+	}
+	if err != nil {
+		return name, fmt.Errorf("unable to create namespace %s: %w", name, err)
+	}
+	if op == controllerutil.OperationResultCreated {
+		logger.Info("created namespace for PR", "namespace", name, "prNumber", prDetails.Number)
+	}
+
+	objectMeta := metav1.ObjectMeta{Name: PR_NAMESPACE_OBJECT_NAME, Namespace: name}
+
+	if prNamespace.ResourceQuota != nil {
+		resourceQuota := &corev1.ResourceQuota{ObjectMeta: objectMeta}
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, resourceQuota, func() error {
+			resourceQuota.Labels = mergeLabels(resourceQuota.Labels, labels)
+			resourceQuota.Spec = *prNamespace.ResourceQuota.DeepCopy()
+			return nil
+		}); err != nil {
+			return name, fmt.Errorf("unable to create ResourceQuota in namespace %s: %w", name, err)
+		}
+	}
+
+	if prNamespace.LimitRange != nil {
+		limitRange := &corev1.LimitRange{ObjectMeta: objectMeta}
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, limitRange, func() error {
+			limitRange.Labels = mergeLabels(limitRange.Labels, labels)
+			limitRange.Spec = *prNamespace.LimitRange.DeepCopy()
+			return nil
+		}); err != nil {
+			return name, fmt.Errorf("unable to create LimitRange in namespace %s: %w", name, err)
+		}
+	}
+
+	if prNamespace.NetworkPolicy != nil {
+		networkPolicy := &networkingv1.NetworkPolicy{ObjectMeta: objectMeta}
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, networkPolicy, func() error {
+			networkPolicy.Labels = mergeLabels(networkPolicy.Labels, labels)
+			networkPolicy.Spec = *prNamespace.NetworkPolicy.DeepCopy()
+			return nil
+		}); err != nil {
+			return name, fmt.Errorf("unable to create NetworkPolicy in namespace %s: %w", name, err)
+		}
+	}
+
+	for _, rb := range prNamespace.RoleBindings {
+		roleBinding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: rb.Name, Namespace: name}}
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, roleBinding, func() error {
+			roleBinding.Labels = mergeLabels(roleBinding.Labels, labels)
+			// The roleRef of an existing RoleBinding is immutable
+			if roleBinding.CreationTimestamp.IsZero() {
+				roleBinding.RoleRef = rb.RoleRef
+			}
+			roleBinding.Subjects = rb.Subjects
+			return nil
+		}); err != nil {
+			return name, fmt.Errorf("unable to create RoleBinding %s in namespace %s: %w", rb.Name, name, err)
+		}
+	}
+
+	return name, nil
+}
+
+// Deletes the namespaces created for PRs which are no longer open. A namespace is only deleted once the Flux
+// HelmRelease of the PR no longer exists, so that Flux can uninstall the release before the namespace is removed.
+func (r *PREphemeralEnvControllerReconciler) DeletePRNamespaces(ctx context.Context, helmReleases map[int]fluxhelmrelease.HelmRelease, prDetails map[int]PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	logger := log.FromContext(ctx)
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces, client.MatchingLabels{
+		CONTROLLER_NAME_LABEL:      prController.Name,
+		CONTROLLER_NAMESPACE_LABEL: prController.Namespace,
+	}); err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces.Items {
+		prNumber, err := strconv.Atoi(namespace.Labels[PR_NUMBER_LABEL])
+		if err != nil {
+			logger.Error(err, "namespace has an invalid PR number label", "namespace", namespace.Name)
+			continue
+		}
+		if _, ok := prDetails[prNumber]; ok {
+			continue
+		}
+		if _, ok := helmReleases[prNumber]; ok {
+			// Wait for Flux to uninstall the release
+			continue
+		}
+		if !namespace.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := r.Delete(ctx, &namespace); client.IgnoreNotFound(err) != nil {
+			mesg := fmt.Sprintf("unable to delete namespace %s for prNumber: %d", namespace.Name, prNumber)
+			r.Record.Event(prController, "Warning", "NamespaceDeleteFailed", mesg)
+			logger.Error(err, mesg)
+			return err
+		}
+		mesg := fmt.Sprintf("Deleted namespace %s of prNumber: %d", namespace.Name, prNumber)
+		r.Record.Event(prController, "Normal", "NamespaceDeleted", mesg)
+		logger.Info(mesg, "prNumber", prNumber)
+	}
+
+	return nil
+}
+
+// Checks if the object has the labels of the objects created by the controller
+func isOwnedByController(obj client.Object, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) bool {
+	labels := obj.GetLabels()
+	return labels[CONTROLLER_NAME_LABEL] == prController.Name && labels[CONTROLLER_NAMESPACE_LABEL] == prController.Namespace
+}
+
+// Returns a new map containing the labels of all maps passed, later maps take precedence
+func mergeLabels(labelMaps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, labels := range labelMaps {
+		for key, value := range labels {
+			merged[key] = value
+		}
+	}
+	return merged
+}
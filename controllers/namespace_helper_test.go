@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetPRNamespaceName(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		prNamespace *prcontrollerephemeralenviov1alpha1.PRNamespace
+		expected    string
+		wantErr     bool
+	}{
+		{name: "not configured"},
+		{name: "default template", prNamespace: &prcontrollerephemeralenviov1alpha1.PRNamespace{}, expected: "pr-42"},
+		{name: "custom template", prNamespace: &prcontrollerephemeralenviov1alpha1.PRNamespace{NameTemplate: "shop-pr-<<PR_NUMBER>>"}, expected: "shop-pr-42"},
+		{name: "invalid name", prNamespace: &prcontrollerephemeralenviov1alpha1.PRNamespace{NameTemplate: "Shop_<<PR_NUMBER>>"}, wantErr: true},
+		{name: "shared by all PRs", prNamespace: &prcontrollerephemeralenviov1alpha1.PRNamespace{NameTemplate: "shop-preview"}, wantErr: true},
+		{name: "new namespace for every commit", prNamespace: &prcontrollerephemeralenviov1alpha1.PRNamespace{NameTemplate: "shop-pr-<<PR_NUMBER>>-<<PR_HEAD_SHA>>"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name, err := getPRNamespaceName(tc.prNamespace, testPRDetails)
+			if (err != nil) != tc.wantErr || name != tc.expected {
+				t.Errorf("expected namespace %q with error %v, got %q with %v", tc.expected, tc.wantErr, name, err)
+			}
+		})
+	}
+}
+
+func TestEnsurePRNamespace(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+	prController.Spec.PRNamespace = &prcontrollerephemeralenviov1alpha1.PRNamespace{
+		NameTemplate: "shop-pr-<<PR_NUMBER>>",
+		Labels:       map[string]string{"team": "checkout"},
+		ResourceQuota: &corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+		},
+		RoleBindings: []prcontrollerephemeralenviov1alpha1.PRNamespaceRoleBinding{{
+			Name:     "developers",
+			RoleRef:  rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "edit"},
+			Subjects: []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: "Group", Name: "checkout-devs"}},
+		}},
+	}
+	r := &PREphemeralEnvControllerReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()}
+
+	// The second call updates the objects created by the first one
+	for i := 0; i < 2; i++ {
+		name, err := r.EnsurePRNamespace(context.Background(), prController, testPRDetails)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "shop-pr-42" {
+			t.Fatalf("expected the namespace shop-pr-42, got %q", name)
+		}
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: "shop-pr-42"}, namespace); err != nil {
+		t.Fatal(err)
+	}
+	expectedLabels := mergeLabels(map[string]string{"team": "checkout"}, getPRLabels(prController, 42))
+	if !reflect.DeepEqual(namespace.Labels, expectedLabels) {
+		t.Errorf("expected the namespace labels %v, got %v", expectedLabels, namespace.Labels)
+	}
+
+	resourceQuota := &corev1.ResourceQuota{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "shop-pr-42", Name: PR_NAMESPACE_OBJECT_NAME}, resourceQuota); err != nil {
+		t.Fatal(err)
+	}
+	if pods := resourceQuota.Spec.Hard[corev1.ResourcePods]; pods.Value() != 10 {
+		t.Errorf("expected a quota of 10 pods, got %s", pods.String())
+	}
+
+	roleBinding := &rbacv1.RoleBinding{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "shop-pr-42", Name: "developers"}, roleBinding); err != nil {
+		t.Fatal(err)
+	}
+	if roleBinding.RoleRef.Name != "edit" || len(roleBinding.Subjects) != 1 || roleBinding.Subjects[0].Name != "checkout-devs" {
+		t.Errorf("expected the developers to be bound to edit, got %+v", roleBinding)
+	}
+}
+
+func TestEnsurePRNamespaceConflict(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+	prController.Spec.PRNamespace = &prcontrollerephemeralenviov1alpha1.PRNamespace{NameTemplate: "shop-pr-<<PR_NUMBER>>"}
+	otherController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "staging"}}
+
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+	}{
+		{name: "created by someone else", labels: map[string]string{"team": "payments"}},
+		{name: "created by another controller", labels: getPRLabels(otherController, 42)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			existing := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop-pr-42", Labels: tc.labels}}
+			r := &PREphemeralEnvControllerReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(existing).Build()}
+
+			name, err := r.EnsurePRNamespace(context.Background(), prController, testPRDetails)
+			if !errors.Is(err, errPRNamespaceConflict) || name != "shop-pr-42" {
+				t.Fatalf("expected a conflict for the namespace shop-pr-42, got %q with %v", name, err)
+			}
+			namespace := &corev1.Namespace{}
+			if err := r.Get(context.Background(), types.NamespacedName{Name: "shop-pr-42"}, namespace); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(namespace.Labels, tc.labels) {
+				t.Errorf("expected the namespace not to be adopted, got the labels %v", namespace.Labels)
+			}
+		})
+	}
+}
+
+func TestDeletePRNamespaces(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+	otherController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "blog", Namespace: "ci"}}
+	newPRNamespace := func(name string, owner *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prNumber int) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: getPRLabels(owner, prNumber)}}
+	}
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			newPRNamespace("shop-pr-1", prController, 1),
+			newPRNamespace("shop-pr-2", prController, 2),
+			newPRNamespace("shop-pr-3", prController, 3),
+			newPRNamespace("blog-pr-4", otherController, 4),
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+		).Build(),
+		Record: record.NewFakeRecorder(10),
+	}
+
+	// PR 1 is open, Flux is still uninstalling the release of the closed PR 2 and PR 3 is closed
+	helmReleases := map[int]fluxhelmrelease.HelmRelease{1: {}, 2: {}}
+	prDetails := map[int]PRDetails{1: {Number: 1}}
+	if err := r.DeletePRNamespaces(context.Background(), helmReleases, prDetails, prController); err != nil {
+		t.Fatal(err)
+	}
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(context.Background(), &namespaces); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, namespace := range namespaces.Items {
+		names = append(names, namespace.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"blog-pr-4", "kube-system", "shop-pr-1", "shop-pr-2"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the namespaces %v to be left, got %v", expected, names)
+	}
+}
@@ -19,17 +19,28 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"go.opentelemetry.io/otel/trace"
 
 	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
 	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
@@ -38,18 +49,32 @@ import (
 // PREphemeralEnvControllerReconciler reconciles a PREphemeralEnvController object
 type PREphemeralEnvControllerReconciler struct {
 	client.Client
-	Scheme              *runtime.Scheme
-	Record              record.EventRecorder
-	GHPRRepo            prcontrollerephemeralenviov1alpha1.GithubPRRepository
-	GHPATToken          string
-	EnvCreationHelmRepo prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo
+	Scheme             *runtime.Scheme
+	Record             record.EventRecorder
+	Config             *rest.Config
+	Prober             *HealthProber
+	HealthProbeWorkers int
+	// Number of PREphemeralEnvControllers reconciled at once, defaults to 1
+	MaxConcurrentReconciles int
+	// ClusterRoles which the roleBindings of the PR namespaces can bind, defaults to DEFAULT_BINDABLE_CLUSTER_ROLES
+	BindableClusterRoles []string
+	// Namespaces, besides the namespace of each PREphemeralEnvController, from which valuesFrom Secrets can be copied
+	SecretSourceNamespaces []string
+	TracerProvider         trace.TracerProvider
 }
 
-func (r *PREphemeralEnvControllerReconciler) getEnvHealthCheckUrl(urlTemplate string, prNumber int, prHeadSHA string) string {
+func (r *PREphemeralEnvControllerReconciler) getBindableClusterRoles() []string {
+	if len(r.BindableClusterRoles) == 0 {
+		return DEFAULT_BINDABLE_CLUSTER_ROLES
+	}
+	return r.BindableClusterRoles
+}
 
-	healthCheckUrl := strings.ReplaceAll(urlTemplate, "<<PR_NUMBER>>", fmt.Sprintf("%d", prNumber))
-	healthCheckUrl = strings.ReplaceAll(healthCheckUrl, "<<PR_HEAD_SHA>>", prHeadSHA)
-	return healthCheckUrl
+// replaces the <<PR_NUMBER>> and <<PR_HEAD_SHA>> placeholders in the template passed
+func replacePRPlaceholders(template string, prNumber int, prHeadSHA string) string {
+	replaced := strings.ReplaceAll(template, "<<PR_NUMBER>>", fmt.Sprintf("%d", prNumber))
+	replaced = strings.ReplaceAll(replaced, "<<PR_HEAD_SHA>>", prHeadSHA)
+	return replaced
 }
 
 func (r *PREphemeralEnvControllerReconciler) getGHToken(ctx context.Context, prController prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) (string, error) {
@@ -101,8 +126,20 @@ func getPRDetailsForHelmRelease(ctx context.Context, helmRelease fluxhelmrelease
 //+kubebuilder:rbac:groups=prcontroller.controllers.ephemeralenv.io,resources=prephemeralenvcontrollers/finalizers,verbs=update
 //+kubebuilder:rbac:groups=helm.toolkit.fluxcd.io,resources=helmreleases,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=helm.crossplane.io,resources=releases,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=namespaces;resourcequotas;limitranges,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups="",resources=services/proxy,verbs=get
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshotcontents,verbs=get;list;watch;create;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind,resourceNames=view;edit
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -113,16 +150,11 @@ func getPRDetailsForHelmRelease(ctx context.Context, helmRelease fluxhelmrelease
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.12.2/pkg/reconcile
-func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
-
-	// TODO(user): your logic here
+func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	ctx, span := r.startSpan(ctx, "Reconcile", trace.WithAttributes(CONTROLLER_ATTRIBUTE.String(req.String())))
+	defer func() { endSpan(span, err) }()
 	logger := log.FromContext(ctx)
 
-	// TODO(user): your logic here
-
-	var err error
-
 	var prController prcontrollerephemeralenviov1alpha1.PREphemeralEnvController
 
 	// List of PRDetails for all Open Github Pull Requests
@@ -143,6 +175,11 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 	PRNumPRDetailsMapForHelmReleases := make(map[int]PRDetails)
 
 	if err := r.Get(ctx, req.NamespacedName, &prController); err != nil {
+		if apierrors.IsNotFound(err) {
+			// Stop probing the environments of a deleted PRController, and remove its metrics
+			r.Prober.Prune(req.NamespacedName, time.Now())
+			forgetEnvironments(req.NamespacedName)
+		}
 		logger.Error(err, "unable to fetch PRController")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
@@ -154,8 +191,8 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 	}
 
 	// Get the github tokentoken from the secretref specified in the CRD
-	r.GHPATToken, err = r.getGHToken(ctx, prController)
-	if err != nil || len(r.GHPATToken) == 0 {
+	ghToken, err := r.getGHToken(ctx, prController)
+	if err != nil || len(ghToken) == 0 {
 		logger.Error(err, "unable to fetch Token")
 		prController.Status.Message = "TokenLoadFailed"
 		_ = r.Status().Update(ctx, &prController)
@@ -163,14 +200,93 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 		r.Record.Event(&prController, "Warning", "TokenLoadFailed", mesg)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
-	r.GHPRRepo.User = prController.Spec.GithubPRRepository.User
-	r.GHPRRepo.Repo = prController.Spec.GithubPRRepository.Repo
 
-	r.GHPRRepo = *prController.Spec.GithubPRRepository
-	r.EnvCreationHelmRepo = *prController.Spec.EnvCreationHelmRepo
+	// The Github repository and token are carried in the context, as other PRControllers can be reconciled at the
+	// same time
+	tokenSecretRef := prController.Spec.GithubPRRepository.TokenSecretRef
+	ghRepo := GHRepo{
+		User:        prController.Spec.GithubPRRepository.User,
+		Repo:        prController.Spec.GithubPRRepository.Repo,
+		Token:       ghToken,
+		TokenSecret: fmt.Sprintf("%s/%s/%s", tokenSecretRef.Namespace, tokenSecretRef.Name, tokenSecretRef.Key),
+	}
+	ctx = WithGHRepo(ctx, ghRepo)
+
+	// Validate that the helmReleaseTemplate can be merged into the generated HelmRelease spec
+	if err := ValidateHelmReleaseTemplate(*prController.Spec.EnvCreationHelmRepo); err != nil {
+		logger.Error(err, "invalid helmReleaseTemplate")
+		prController.Status.Message = "InvalidHelmReleaseTemplate"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidHelmReleaseTemplate", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Validate the namespace the valuesFrom Secrets are copied from
+	if err := ValidateCopySecretsFromNamespace(&prController, r.SecretSourceNamespaces); err != nil {
+		logger.Error(err, "invalid copySecretsFromNamespace")
+		prController.Status.Message = "InvalidCopySecretsFromNamespace"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidCopySecretsFromNamespace", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Validate the hibernation schedule
+	if err := ValidateSchedule(prController.Spec.Schedule); err != nil {
+		logger.Error(err, "invalid schedule")
+		prController.Status.Message = "InvalidSchedule"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidSchedule", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Validate the namespace per PR configuration
+	if err := ValidatePRNamespace(prController.Spec.PRNamespace, r.getBindableClusterRoles()); err != nil {
+		logger.Error(err, "invalid prNamespace")
+		prController.Status.Message = "InvalidPRNamespace"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidPRNamespace", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Validate the Job templates of the hooks
+	if err := ValidateHooks(prController.Spec.Hooks); err != nil {
+		logger.Error(err, "invalid hooks")
+		prController.Status.Message = "InvalidHooks"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidHooks", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Validate the Job template of the smoke test
+	if prController.Spec.SmokeTest != nil {
+		if _, err := renderHookJobSpec(prController.Spec.SmokeTest, PRDetails{}); err != nil {
+			logger.Error(err, "invalid smoke test")
+			prController.Status.Message = "InvalidSmokeTest"
+			_ = r.Status().Update(ctx, &prController)
+			r.Record.Event(&prController, "Warning", "InvalidSmokeTest", err.Error())
+			return ctrl.Result{}, nil
+		}
+	}
+
+	// Validate the health checks
+	if err := ValidateHealthChecks(getHealthChecks(prController.Spec)); err != nil {
+		logger.Error(err, "invalid health checks")
+		prController.Status.Message = "InvalidHealthCheck"
+		_ = r.Status().Update(ctx, &prController)
+		r.Record.Event(&prController, "Warning", "InvalidHealthCheck", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Back off from Github until the rate limit resets if the remaining quota is low
+	if rate, ok := GetGHRateLimit(ghRepo); ok && isGHRateLimitLow(rate, time.Now()) {
+		return r.BackOffRateLimited(ctx, &prController, rate.Reset.Time, time.Now())
+	}
 
 	// Get Active Pull Requests from Github
-	prDetails, err = r.GetActivePullRequests()
+	prDetails, err = r.GetActivePullRequests(ctx)
+	if reset, ok := getGHRateLimitReset(err, time.Now()); ok {
+		return r.BackOffRateLimited(ctx, &prController, reset, time.Now())
+	}
 	if err != nil {
 		mesg := "Unable to fetch active pull requests from Github"
 		r.Record.Event(&prController, "Warning", "PRFetchFailed", mesg)
@@ -181,6 +297,7 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	clearRateLimited(&prController)
 
 	// Fetch all Helm Releases in the Cluster, and in the namespace specified in the CRD
 	if err := r.List(ctx, &helmReleaseList, client.InNamespace(prController.Spec.EnvCreationHelmRepo.DestinationNamespace)); err != nil {
@@ -198,8 +315,30 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 		PRNumHelmReleaseMap[prDet.Number] = helmRelease
 	}
 
-	// If no errors till this point then mark controller as ready
+	// Copy the Secrets referenced in valuesFrom to the destination namespace if configured
+	if !prController.Spec.Suspend {
+		if err := r.CopyValuesFromSecrets(ctx, &prController); err != nil {
+			mesg := "Unable to copy valuesFrom Secrets to the destination namespace"
+			r.Record.Event(&prController, "Warning", "SecretCopyFailed", mesg)
+			logger.Error(err, mesg)
+		}
+		if err := r.DeleteUnreferencedValuesSecrets(ctx, &prController, helmReleaseList.Items); err != nil {
+			mesg := "Unable to delete valuesFrom Secrets no longer referenced from the destination namespace"
+			r.Record.Event(&prController, "Warning", "SecretDeleteFailed", mesg)
+			logger.Error(err, mesg)
+		}
+	}
+
+	// If no errors till this point then mark controller as ready, or as suspended. The Suspended event is only
+	// emitted when the controller becomes suspended
+	previousMessage := prController.Status.Message
 	prController.Status.Message = "Ready"
+	if prController.Spec.Suspend {
+		prController.Status.Message = "Suspended"
+		if previousMessage != "Suspended" {
+			r.Record.Event(&prController, "Normal", "Suspended", "Reconciliation is suspended, PR environments are not changed")
+		}
+	}
 	err = r.Status().Update(context.Background(), &prController)
 	if err != nil {
 		logger.Error(err, "unable to update PRController status")
@@ -218,15 +357,92 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 		r.Record.Event(&prController, "Normal", "NoActivePRs", "No active PRs found")
 	}
 
+	// Count the HelmReleases which Flux is currently installing or upgrading, to limit the number of concurrent rollouts
+	upgradesInProgress := 0
+	for _, helmRel := range PRNumHelmReleaseMap {
+		if isHelmReleaseInProgress(helmRel) {
+			upgradesInProgress++
+		}
+	}
+
+	now := metav1.Now()
+
+	// PRs beyond maxEnvironments, which have to wait for an environment to be removed
+	queuedPRs := getQueuedPRs(&prController, prDetails, PRNumHelmReleaseMap)
+
 	// Create / Update Flux HelmRelease for each Active Github PR
 	for _, pr := range prDetails {
 		var prHelmRel PRDetails
 		var ok bool
 
+		envStatus := getPREnvStatus(&prController, pr.Number)
+
+		// The PR was reopened within the deletion grace period, keep its environment
+		if envStatus.ClosedAt != nil {
+			envStatus.ClosedAt = nil
+			envStatus.Outcome = ""
+			envStatus.MergeCommitSHA = ""
+			envStatus.Message = ""
+		}
+
+		// Only observe the PR if the controller is suspended or the environment of the PR is frozen
+		helmRel, helmRelExists := PRNumHelmReleaseMap[pr.Number]
+		envStatus.Suspended = prController.Spec.Suspend || (helmRelExists && isHelmReleaseFrozen(helmRel))
+		if envStatus.Suspended {
+			logger.Info("Skipping changes to the environment of the PR, as it is suspended", "pr", pr)
+			continue
+		}
+
+		// Environments removed after they expired are only recreated when a new commit is pushed to the PR
+		if envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseExpired {
+			if envStatus.HeadSHA == pr.HeadSHA {
+				continue
+			}
+			if helmRelExists && !helmRel.DeletionTimestamp.IsZero() {
+				logger.Info("Waiting for expired environment to be removed before recreating it", "pr", pr)
+				continue
+			}
+		}
+
+		// Queued PRs are promoted once an environment slot is free
+		if position, queued := queuedPRs[pr.Number]; queued {
+			description := fmt.Sprintf("Waiting for capacity (position %d)", position)
+			if envStatus.Phase != prcontrollerephemeralenviov1alpha1.EnvPhaseQueued || envStatus.Message != description || envStatus.HeadSHA != pr.HeadSHA {
+				envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseQueued
+				envStatus.Message = description
+				envStatus.HeadSHA = pr.HeadSHA
+				mesg := fmt.Sprintf("Maximum number of environments reached, PR %d is queued at position %d", pr.Number, position)
+				r.Record.Event(&prController, "Normal", "EnvQueued", mesg)
+				logger.Info(mesg)
+				if err := r.UpdatePRStatus(ctx, &prController, pr.Number, pr.HeadSHA, "pending", description); err != nil {
+					logger.Error(err, "Unable to update PR status")
+				}
+			}
+			continue
+		}
+
+		// Create the namespace for the PR if namespace per PR is configured
+		targetNamespace, err := r.EnsurePRNamespace(ctx, &prController, pr)
+		if errors.Is(err, errPRNamespaceConflict) {
+			mesg := fmt.Sprintf("Namespace %s for PR %d already exists and was not created by this controller", targetNamespace, pr.Number)
+			envStatus.Message = mesg
+			r.Record.Event(&prController, "Warning", "NamespaceConflict", mesg)
+			logger.Error(err, mesg)
+			continue
+		}
+		if err != nil {
+			mesg := fmt.Sprintf("Unable to create namespace for PR %d", pr.Number)
+			r.Record.Event(&prController, "Warning", "UnableToCreateNamespace", mesg)
+			logger.Error(err, mesg)
+			continue
+		}
+
 		// Check if Flux HelmRelease already exists for the PR, if not create
 		if prHelmRel, ok = PRNumPRDetailsMapForHelmReleases[pr.Number]; !ok {
 			logger.Info("Creating Env Flux Helm Release for PR", "pr", pr)
-			if err := r.CreateFluxHelmRelease(ctx, pr); err != nil {
+			err := r.CreateFluxHelmRelease(ctx, &prController, pr, targetNamespace)
+			recordEnvOperation(&prController, ENV_OPERATION_CREATE, err)
+			if err != nil {
 				mesg := fmt.Sprintf("Unable to create flux helm release for PR %d", pr.Number)
 				r.Record.Event(&prController, "Warning", "UnableToCreateHelmRelease", mesg)
 				logger.Error(err, mesg, "prDetails", prDetails)
@@ -235,28 +451,102 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 
 			mesg := fmt.Sprintf("New flux HelmRelease created for PR %d", pr.Number)
 			r.Record.Event(&prController, "Normal", "FluxHelmRelCrtd", mesg)
+			markPREnvDeployed(envStatus, pr, now)
+			envStatus.ExpiresAt, _ = getPREnvExpiry(prController.Spec, envStatus)
+
+			// A new PR created outside the active windows stays awake like after a new commit
+			if prController.Spec.Schedule != nil {
+				envStatus.AwakeUntil = getAwakeUntil(prController.Spec.Schedule, now)
+			}
 
 			// Update PR Status. If no healthcheck endpoint is specified, then mark as success
-			envStatus := "success"
+			prStatus := "success"
 			description := "Ephemeral environment creation request submitted"
-			if prController.Spec.EnvHealthCheckURLTemplate != "" {
-				envStatus = "pending"
+			if len(getHealthChecks(prController.Spec)) > 0 || prController.Spec.SmokeTest != nil {
+				prStatus = "pending"
 				description = "Creation of ephemeral environment for PR in progress"
 			}
-			err = r.UpdatePRStatus(ctx, pr.Number, pr.HeadSHA, envStatus, description)
+			err = r.UpdatePRStatus(ctx, &prController, pr.Number, pr.HeadSHA, prStatus, description)
 			if err != nil {
 				logger.Error(err, "Unable to update PR status")
 			}
 			continue
 		}
 
+		// Environments created before the controller tracked their status
+		if envStatus.CreatedAt == nil {
+			createdAt := helmRel.CreationTimestamp
+			envStatus.CreatedAt = &createdAt
+			envStatus.LastCommitAt = &now
+			envStatus.HeadSHA = prHelmRel.HeadSHA
+			envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseActive
+		}
+
+		// Remove the environment once it is older than the ttl, or no new commits were pushed for the idle timeout.
+		// A new commit resets the idle timeout, so the expiry is only checked if the PR head SHA is unchanged
+		if prHelmRel.HeadSHA == pr.HeadSHA {
+			expiresAt, reason := getPREnvExpiry(prController.Spec, envStatus)
+			envStatus.ExpiresAt = expiresAt
+			if expiresAt != nil && !now.Before(expiresAt) {
+				if resumed, err := r.ResumeHibernatedHelmRelease(ctx, helmRel, envStatus); err != nil || !resumed {
+					if err != nil {
+						logger.Error(err, "unable to resume hibernated environment before removing it", "pr", pr)
+					}
+					continue
+				}
+				if !r.RunPreDeleteHook(ctx, helmRel, pr, envStatus, &prController, now) {
+					continue
+				}
+				if err := r.ExpireFluxHelmRelease(ctx, helmRel, pr, reason, envStatus, &prController); err != nil {
+					logger.Error(err, "unable to remove expired environment", "pr", pr)
+				}
+				continue
+			}
+		}
+
+		// Hibernate environments outside the active windows of the schedule, and wake them up on schedule or when
+		// a new commit is pushed to the PR
+		if prController.Spec.Schedule != nil {
+			if prHelmRel.HeadSHA != pr.HeadSHA {
+				envStatus.AwakeUntil = getAwakeUntil(prController.Spec.Schedule, now)
+			}
+			hibernate, err := shouldHibernate(prController.Spec.Schedule, envStatus, now)
+			if err != nil {
+				logger.Error(err, "unable to evaluate schedule", "pr", pr)
+			} else if hibernate {
+				if err := r.HibernateEnv(ctx, helmRel, pr, envStatus, &prController); err != nil {
+					mesg := fmt.Sprintf("unable to hibernate environment for PR %d", pr.Number)
+					r.Record.Event(&prController, "Warning", "HibernateFailed", mesg)
+					logger.Error(err, mesg)
+				}
+				continue
+			} else if envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseHibernated {
+				if err := r.WakeEnv(ctx, helmRel, pr, targetNamespace, envStatus, &prController); err != nil {
+					mesg := fmt.Sprintf("unable to wake up environment for PR %d", pr.Number)
+					r.Record.Event(&prController, "Warning", "WakeUpFailed", mesg)
+					logger.Error(err, mesg)
+					continue
+				}
+				markPREnvDeployed(envStatus, pr, now)
+				continue
+			}
+		}
+
 		// Check if HeadSHA for PR has changed
 		if prHelmRel.HeadSHA != pr.HeadSHA {
 			logger.Info("Updating Flux helm release for PR", "pr", pr)
-			if err := r.UpdateFluxHelmRelease(ctx, PRNumHelmReleaseMap[pr.Number], pr); err != nil {
+			err := r.UpdateFluxHelmRelease(ctx, &prController, helmRel, pr, targetNamespace)
+			recordEnvOperation(&prController, ENV_OPERATION_UPDATE, err)
+			if err != nil {
 				mesg := fmt.Sprintf("unable to update flux helm release for PR %d", pr.Number)
-				r.Record.Event(&prController, "Warning", "UnableToCreateHelmRelease", mesg)
+				r.Record.Event(&prController, "Warning", "UnableToUpdateHelmRelease", mesg)
 				logger.Error(err, mesg, "prDetails", prDetails)
+				continue
+			}
+			markPREnvDeployed(envStatus, pr, now)
+			envStatus.ExpiresAt, _ = getPREnvExpiry(prController.Spec, envStatus)
+			if !isHelmReleaseInProgress(helmRel) {
+				upgradesInProgress++
 			}
 			logger.Info("Updated Flux Helm Release for PR", "PR Number:", pr.Number, "PR SHA:", pr.HeadSHA)
 			mesg := fmt.Sprintf("Flux HelmRelease updated for PR %d", pr.Number)
@@ -264,29 +554,127 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 			continue
 		}
 
+		// Check if the HelmRelease differs from the spec generated from the CRD, for instance after a chart version
+		// bump, and roll out the change. New commits are always rolled out, while spec changes are limited to
+		// maxConcurrentUpgrades HelmReleases being upgraded at once
+		upToDate, err := r.IsFluxHelmReleaseUpToDate(*prController.Spec.EnvCreationHelmRepo, helmRel, pr, targetNamespace)
+		if err != nil {
+			mesg := fmt.Sprintf("unable to compare flux helm release for PR %d", pr.Number)
+			r.Record.Event(&prController, "Warning", "UnableToUpdateHelmRelease", mesg)
+			logger.Error(err, mesg)
+			continue
+		}
+		if !upToDate {
+			maxUpgrades := prController.Spec.MaxConcurrentUpgrades
+			if maxUpgrades > 0 && upgradesInProgress >= maxUpgrades && !isHelmReleaseInProgress(helmRel) {
+				mesg := fmt.Sprintf("Maximum concurrent upgrades reached, postponing rollout of spec changes for PR %d", pr.Number)
+				r.Record.Event(&prController, "Normal", "RolloutPostponed", mesg)
+				logger.Info(mesg, "upgradesInProgress", upgradesInProgress)
+				continue
+			}
+			logger.Info("Rolling out spec changes to Flux helm release for PR", "pr", pr)
+			err := r.UpdateFluxHelmRelease(ctx, &prController, helmRel, pr, targetNamespace)
+			recordEnvOperation(&prController, ENV_OPERATION_UPDATE, err)
+			if err != nil {
+				mesg := fmt.Sprintf("unable to roll out spec changes to flux helm release for PR %d", pr.Number)
+				r.Record.Event(&prController, "Warning", "UnableToUpdateHelmRelease", mesg)
+				logger.Error(err, mesg)
+				continue
+			}
+			if !isHelmReleaseInProgress(helmRel) {
+				upgradesInProgress++
+			}
+			mesg := fmt.Sprintf("Spec changes rolled out to Flux HelmRelease for PR %d", pr.Number)
+			r.Record.Event(&prController, "Normal", "FluxHelmRelRolledOut", mesg)
+			continue
+		}
+
 		// Else No change in PR, so do nothing
 		mesg := fmt.Sprintf("Flux HelmRelease already exists for PR and is up to date, PR %d", pr.Number)
 		r.Record.Event(&prController, "Normal", "FluxHelmRelExists", mesg)
 		logger.Info(mesg, "pr", pr)
-		if prController.Spec.EnvHealthCheckURLTemplate != "" && IsEnvReady(r.getEnvHealthCheckUrl(prController.Spec.EnvHealthCheckURLTemplate, pr.Number, pr.HeadSHA)) {
-			logger.Info("Environment is ready for PR", "pr", pr)
-			mesg := fmt.Sprintf("Environment is ready for PR %d", pr.Number)
-			r.Record.Event(&prController, "Normal", "EnvReady", mesg)
-			err = r.UpdatePRStatus(ctx, pr.Number, pr.HeadSHA, "success", "Successully created ephemeral environment for PR")
-			if err != nil {
-				logger.Error(err, "unable to update PR status")
+
+		// Run the postCreate hook once the environment is up, the environment is only reported ready once it succeeded
+		if !r.RunPostCreateHook(ctx, helmRel, pr, envStatus, &prController, now) {
+			continue
+		}
+		healthChecks := getHealthChecks(prController.Spec)
+		if len(healthChecks) == 0 && prController.Spec.SmokeTest == nil {
+			continue
+		}
+		if len(healthChecks) > 0 {
+			envNamespace := targetNamespace
+			if envNamespace == "" {
+				envNamespace = prController.Spec.EnvCreationHelmRepo.DestinationNamespace
+			}
+			if !r.CheckEnvHealth(ctx, healthChecks, pr, envNamespace, envStatus, &prController, now) {
+				if envStatus.Phase != prcontrollerephemeralenviov1alpha1.EnvPhaseFailed && isReadinessTimedOut(prController.Spec, envStatus, now) {
+					r.FailEnvReadiness(ctx, healthChecks, pr, envStatus, &prController, now)
+				}
+				continue
+			}
+			if envStatus.ReadyAt == nil {
+				envStatus.ReadyAt = &now
 			}
+			if envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseFailed {
+				envStatus.Phase = prcontrollerephemeralenviov1alpha1.EnvPhaseActive
+				envStatus.FailedAt = nil
+				envStatus.Message = ""
+			}
+		}
+
+		// Run the smoke test once the health checks pass, the environment is only reported ready once it succeeded
+		if !r.RunSmokeTest(ctx, helmRel, pr, envStatus, &prController, now) {
+			continue
+		}
+		// The environment is only reported ready once for each PR head SHA
+		description := "Successully created ephemeral environment for PR"
+		if isPRStatusReported(envStatus, "", pr.HeadSHA, "success", description) {
+			continue
+		}
+		logger.Info("Environment is ready for PR", "pr", pr)
+		mesg = fmt.Sprintf("Environment is ready for PR %d", pr.Number)
+		r.Record.Event(&prController, "Normal", "EnvReady", mesg)
+		// Only the time to ready of the commit the environment was created for is observed
+		if envStatus.CreatedAt != nil && envStatus.LastCommitAt != nil && envStatus.CreatedAt.Equal(envStatus.LastCommitAt) {
+			recordEnvReady(&prController, pr, now.Time)
+		}
+		err = r.UpdatePRStatus(ctx, &prController, pr.Number, pr.HeadSHA, "success", description)
+		if err != nil {
+			logger.Error(err, "unable to update PR status")
 		}
 
 	}
 
-	// Delete HelmRelease for closed PRs if any
-	err = r.DeleteFluxHelmRelease(ctx, PRNumHelmReleaseMap, PRNumPRDetailsMap, &prController)
-	if err != nil {
-		logger.Error(err, "Unexpected error occured when trying to delete flux helm release")
+	if !prController.Spec.Suspend {
+		// Delete HelmRelease for closed PRs if any
+		err = r.DeleteFluxHelmRelease(ctx, PRNumHelmReleaseMap, PRNumPRDetailsMap, &prController, now)
+		if err != nil {
+			logger.Error(err, "Unexpected error occured when trying to delete flux helm release")
+		}
+
+		// Delete namespaces of closed PRs once their HelmRelease has been uninstalled
+		if prController.Spec.PRNamespace != nil {
+			if err := r.DeletePRNamespaces(ctx, PRNumHelmReleaseMap, PRNumPRDetailsMap, &prController); err != nil {
+				logger.Error(err, "Unexpected error occured when trying to delete PR namespaces")
+			}
+		}
+	}
+
+	// Stop probing the health checks which were not checked in this reconcile, like those of closed PRs
+	r.Prober.Prune(req.NamespacedName, now.Time)
+
+	// Persist the status of the PR environments
+	prunePREnvStatuses(&prController, PRNumPRDetailsMap, PRNumHelmReleaseMap)
+	recordEnvironments(&prController)
+	if err := r.Status().Update(ctx, &prController); err != nil {
+		logger.Error(err, "unable to update PRController status")
 	}
 
 	requeueAfter := prController.Spec.Interval.Duration
+	if nextExpiry := getNextPREnvExpiry(&prController, now); nextExpiry > 0 && nextExpiry < requeueAfter {
+		requeueAfter = nextExpiry
+	}
 	if requeueAfter < 60*time.Second {
 		requeueAfter = 60 * time.Second
 	}
@@ -298,7 +686,26 @@ func (r *PREphemeralEnvControllerReconciler) Reconcile(ctx context.Context, req
 // SetupWithManager sets up the controller with the Manager.
 func (r *PREphemeralEnvControllerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.Record = mgr.GetEventRecorderFor("pr-ephem-env-controller-controller")
+
+	// Health checks are probed in the background, and the PRController is reconciled when a result changes
+	if r.Prober == nil {
+		r.Prober = NewHealthProber(r.HealthProbeWorkers)
+	}
+	if err := mgr.Add(r.Prober); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{}).
+		Watches(&source.Channel{Source: r.Prober.Events()}, &handler.EnqueueRequestForObject{}).
+		// Flux state changes of the HelmReleases, and changes of the hook Jobs and PR namespaces, are mapped back to
+		// the PRController through the labels set on them
+		Watches(&source.Kind{Type: &fluxhelmrelease.HelmRelease{}}, handler.EnqueueRequestsFromMapFunc(r.mapHelmReleaseToPRController),
+			builder.WithPredicates(helmReleaseChangedPredicate)).
+		Watches(&source.Kind{Type: &batchv1.Job{}}, handler.EnqueueRequestsFromMapFunc(getOwnerRequests),
+			builder.WithPredicates(createdByControllerPredicate)).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(getOwnerRequests),
+			builder.WithPredicates(createdByControllerPredicate)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
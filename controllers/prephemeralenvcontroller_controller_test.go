@@ -0,0 +1,363 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	fluxmeta "github.com/fluxcd/pkg/apis/meta"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeGithub serves the Github API endpoints used by the controller, and checks that each repository is only
+// accessed with its own token
+type fakeGithub struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (g *fakeGithub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Paths are /repos/<user>/<repo>/pulls and /repos/<user>/<repo>/statuses/<sha>
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "repos" {
+		http.NotFound(w, req)
+		return
+	}
+	repo := parts[2]
+	if auth := req.Header.Get("Authorization"); auth != "Bearer token-"+repo {
+		g.fail(fmt.Sprintf("%s %s sent with %q", req.Method, req.URL.Path, auth))
+	}
+
+	switch {
+	case req.Method == http.MethodGet && parts[3] == "pulls":
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{{
+			"number": 1,
+			"state":  "open",
+			"head":   map[string]interface{}{"sha": "sha-" + repo, "ref": "feature"},
+		}})
+	case req.Method == http.MethodPost && parts[3] == "statuses":
+		if len(parts) < 5 || parts[4] != "sha-"+repo {
+			g.fail(fmt.Sprintf("status of %s posted to %s", req.URL.Path, repo))
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (g *fakeGithub) fail(mesg string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.errors = append(g.errors, mesg)
+}
+
+// multiPRGithub serves the PRs passed, all open, in a single repository
+type multiPRGithub struct {
+	prNumbers []int
+}
+
+func (g *multiPRGithub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/pulls"):
+		prs := []map[string]interface{}{}
+		for _, number := range g.prNumbers {
+			prs = append(prs, map[string]interface{}{
+				"number": number,
+				"state":  "open",
+				"head":   map[string]interface{}{"sha": fmt.Sprintf("sha-%d", number), "ref": "feature"},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(prs)
+	case req.Method == http.MethodPost && strings.Contains(req.URL.Path, "/statuses/"):
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// redirectTransport sends the requests made to the Github API to the test server
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestPRController(name string) (*prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, *corev1.Secret) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{
+			GithubPRRepository: &prcontrollerephemeralenviov1alpha1.GithubPRRepository{
+				User: "org",
+				Repo: name,
+				TokenSecretRef: &prcontrollerephemeralenviov1alpha1.SecretRef{
+					Name:      "gh-" + name,
+					Namespace: "default",
+					Key:       "token",
+				},
+			},
+			EnvCreationHelmRepo: &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+				FluxSourceRepoName:   "charts",
+				HelmChartPath:        "charts/" + name,
+				ChartVersion:         "1.0.0",
+				DestinationNamespace: "envs-" + name,
+			},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gh-" + name, Namespace: "default"},
+		Data:       map[string][]byte{"token": []byte("token-" + name)},
+	}
+	return prController, secret
+}
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{
+		clientgoscheme.AddToScheme,
+		fluxhelmrelease.AddToScheme,
+		prcontrollerephemeralenviov1alpha1.AddToScheme,
+	} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+// Reconciles several PREphemeralEnvControllers at once, each with its own Github repository, token and destination
+// namespace, to be run with -race
+func TestConcurrentReconciles(t *testing.T) {
+	github := &fakeGithub{}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	scheme := newTestScheme(t)
+
+	names := []string{"app-a", "app-b", "app-c", "app-d"}
+	var objects []client.Object
+	for _, name := range names {
+		prController, secret := newTestPRController(name)
+		objects = append(objects, prController, secret)
+	}
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Scheme: scheme,
+		Record: &record.FakeRecorder{},
+		Prober: NewHealthProber(1),
+	}
+
+	for i := 0; i < 5; i++ {
+		var wg sync.WaitGroup
+		for _, name := range names {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+				if _, err := r.Reconcile(context.Background(), req); err != nil {
+					t.Errorf("reconcile of %s failed: %v", name, err)
+				}
+			}(name)
+		}
+		wg.Wait()
+	}
+
+	for _, mesg := range github.errors {
+		t.Error(mesg)
+	}
+	for _, name := range names {
+		var helmReleases fluxhelmrelease.HelmReleaseList
+		if err := r.List(context.Background(), &helmReleases, client.InNamespace("envs-"+name)); err != nil {
+			t.Fatal(err)
+		}
+		if len(helmReleases.Items) != 1 {
+			t.Fatalf("expected 1 HelmRelease in envs-%s, got %d", name, len(helmReleases.Items))
+		}
+		helmRelease := helmReleases.Items[0]
+		if chart := helmRelease.Spec.Chart.Spec.Chart; chart != "charts/"+name {
+			t.Errorf("HelmRelease in envs-%s uses chart %s", name, chart)
+		}
+		if requests := r.mapHelmReleaseToPRController(&helmRelease); len(requests) != 1 || requests[0].Name != name {
+			t.Errorf("HelmRelease in envs-%s is mapped to %v", name, requests)
+		}
+		prDetails, err := getPRDetailsForHelmRelease(context.Background(), helmRelease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prDetails.HeadSHA != "sha-"+name {
+			t.Errorf("HelmRelease in envs-%s was deployed for %s", name, prDetails.HeadSHA)
+		}
+	}
+}
+
+// The Suspended event is only emitted when the PRController becomes suspended, not on every reconcile
+func TestSuspendedEventOnce(t *testing.T) {
+	server := httptest.NewServer(&fakeGithub{})
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	scheme := newTestScheme(t)
+	prController, secret := newTestPRController("app")
+	prController.Spec.Suspend = true
+	recorder := record.NewFakeRecorder(100)
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(prController, secret).Build(),
+		Scheme: scheme,
+		Record: recorder,
+		Prober: NewHealthProber(1),
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	for i := 0; i < 3; i++ {
+		if _, err := r.Reconcile(context.Background(), req); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+	}
+	close(recorder.Events)
+
+	suspended := 0
+	for e := range recorder.Events {
+		if strings.HasPrefix(e, "Normal Suspended ") {
+			suspended++
+		}
+	}
+	if suspended != 1 {
+		t.Errorf("expected 1 Suspended event, got %d", suspended)
+	}
+}
+
+// Spec changes are rolled out to at most maxConcurrentUpgrades HelmReleases at once, HelmReleases which Flux is still
+// upgrading counting against the limit
+func TestMaxConcurrentUpgrades(t *testing.T) {
+	server := httptest.NewServer(&multiPRGithub{prNumbers: []int{1, 2, 3, 4}})
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	ctx := context.Background()
+	scheme := newTestScheme(t)
+	prController, secret := newTestPRController("app")
+	prController.Spec.MaxConcurrentUpgrades = 2
+	recorder := record.NewFakeRecorder(100)
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(prController, secret).Build(),
+		Scheme: scheme,
+		Record: recorder,
+		Prober: NewHealthProber(1),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+
+	reconcile := func() (upgraded int, postponed int) {
+		t.Helper()
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		for len(recorder.Events) > 0 {
+			e := <-recorder.Events
+			if strings.HasPrefix(e, "Normal RolloutPostponed ") {
+				postponed++
+			}
+		}
+		var helmReleases fluxhelmrelease.HelmReleaseList
+		if err := r.List(ctx, &helmReleases, client.InNamespace("envs-app")); err != nil {
+			t.Fatal(err)
+		}
+		for _, helmRel := range helmReleases.Items {
+			if helmRel.Spec.Chart.Spec.Version == "2.0.0" {
+				upgraded++
+			}
+		}
+		return upgraded, postponed
+	}
+	// Sets the Ready condition Flux reports on each HelmRelease, Unknown while the upgrade is in progress
+	setReady := func(status metav1.ConditionStatus) {
+		t.Helper()
+		var helmReleases fluxhelmrelease.HelmReleaseList
+		if err := r.List(ctx, &helmReleases, client.InNamespace("envs-app")); err != nil {
+			t.Fatal(err)
+		}
+		for i := range helmReleases.Items {
+			helmRel := &helmReleases.Items[i]
+			if status == metav1.ConditionUnknown && helmRel.Spec.Chart.Spec.Version != "2.0.0" {
+				continue
+			}
+			apimeta.SetStatusCondition(&helmRel.Status.Conditions, metav1.Condition{
+				Type:   fluxmeta.ReadyCondition,
+				Status: status,
+				Reason: "Test",
+			})
+			if err := r.Status().Update(ctx, helmRel); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// All environments are created regardless of the limit
+	if upgraded, _ := reconcile(); upgraded != 0 {
+		t.Fatalf("expected no upgraded HelmRelease, got %d", upgraded)
+	}
+	setReady(metav1.ConditionTrue)
+
+	// Bump the chart version
+	if err := r.Get(ctx, req.NamespacedName, prController); err != nil {
+		t.Fatal(err)
+	}
+	prController.Spec.EnvCreationHelmRepo.ChartVersion = "2.0.0"
+	if err := r.Update(ctx, prController); err != nil {
+		t.Fatal(err)
+	}
+
+	if upgraded, postponed := reconcile(); upgraded != 2 || postponed != 2 {
+		t.Fatalf("expected 2 upgraded and 2 postponed HelmReleases, got %d and %d", upgraded, postponed)
+	}
+
+	// The upgraded HelmReleases are still in progress, so the others stay postponed
+	setReady(metav1.ConditionUnknown)
+	if upgraded, postponed := reconcile(); upgraded != 2 || postponed != 2 {
+		t.Fatalf("expected the rollout to wait for the upgrades in progress, got %d upgraded and %d postponed", upgraded, postponed)
+	}
+
+	// Once Flux is done, the rollout continues
+	setReady(metav1.ConditionTrue)
+	if upgraded, postponed := reconcile(); upgraded != 4 || postponed != 0 {
+		t.Fatalf("expected all HelmReleases to be upgraded, got %d upgraded and %d postponed", upgraded, postponed)
+	}
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"sort"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+)
+
+// Returns the PRs which have to wait for capacity before their environment can be created, along with their
+// position in the queue (starting at 1). The free environment slots are given to the PRs waiting for an environment
+// in the order defined by the queue policy of the CRD.
+func getQueuedPRs(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, prDetails []PRDetails, helmReleases map[int]fluxhelmrelease.HelmRelease) map[int]int {
+	queued := map[int]int{}
+	maxEnvironments := prController.Spec.MaxEnvironments
+	if maxEnvironments <= 0 {
+		return queued
+	}
+
+	// Environments of closed PRs kept for the deletion grace period still use a slot
+	activeEnvironments := 0
+	for _, helmRel := range helmReleases {
+		if helmRel.DeletionTimestamp.IsZero() {
+			activeEnvironments++
+		}
+	}
+
+	var waiting []PRDetails
+	for _, pr := range prDetails {
+		if helmRel, ok := helmReleases[pr.Number]; ok && helmRel.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if envStatus := findPREnvStatus(prController, pr.Number); envStatus != nil &&
+			envStatus.Phase == prcontrollerephemeralenviov1alpha1.EnvPhaseExpired && envStatus.HeadSHA == pr.HeadSHA {
+			// Expired environments are only recreated on the next push
+			continue
+		}
+		waiting = append(waiting, pr)
+	}
+
+	sortQueue(waiting, prController.Spec.QueuePolicy, prController.Spec.PriorityLabels)
+
+	freeSlots := maxEnvironments - activeEnvironments
+	if freeSlots < 0 {
+		freeSlots = 0
+	}
+	for i, pr := range waiting {
+		if i >= freeSlots {
+			queued[pr.Number] = i - freeSlots + 1
+		}
+	}
+	return queued
+}
+
+// Sorts the PRs waiting for an environment by priority. With the LabelPriority policy, PRs having a label listed
+// earlier in priorityLabels come first. PRs with the same priority are sorted oldest first.
+func sortQueue(prs []PRDetails, queuePolicy string, priorityLabels []string) {
+	priority := func(pr PRDetails) int {
+		if queuePolicy != prcontrollerephemeralenviov1alpha1.QueuePolicyLabelPriority {
+			return 0
+		}
+		for i, priorityLabel := range priorityLabels {
+			for _, label := range pr.Labels {
+				if label == priorityLabel {
+					return i
+				}
+			}
+		}
+		return len(priorityLabels)
+	}
+
+	sort.SliceStable(prs, func(i, j int) bool {
+		pi, pj := priority(prs[i]), priority(prs[j])
+		if pi != pj {
+			return pi < pj
+		}
+		if !prs[i].CreatedAt.Equal(prs[j].CreatedAt) {
+			return prs[i].CreatedAt.Before(prs[j].CreatedAt)
+		}
+		return prs[i].Number < prs[j].Number
+	})
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var queueTestTime = time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// Returns a PR opened the number of hours passed after queueTestTime
+func newQueuedPR(number int, openedAfter int, labels ...string) PRDetails {
+	return PRDetails{
+		Number:    number,
+		HeadSHA:   "sha",
+		CreatedAt: queueTestTime.Add(time.Duration(openedAfter) * time.Hour),
+		Labels:    labels,
+	}
+}
+
+func TestSortQueue(t *testing.T) {
+	prs := []PRDetails{
+		newQueuedPR(1, 3),
+		newQueuedPR(2, 1, "low"),
+		newQueuedPR(3, 2, "urgent"),
+		newQueuedPR(4, 0),
+		newQueuedPR(5, 2, "low", "urgent"),
+		newQueuedPR(6, 2),
+	}
+	for _, tc := range []struct {
+		name           string
+		queuePolicy    string
+		priorityLabels []string
+		expected       []int
+	}{
+		{name: "oldest first", queuePolicy: prcontrollerephemeralenviov1alpha1.QueuePolicyOldestFirst, expected: []int{4, 2, 3, 5, 6, 1}},
+		{name: "default policy", expected: []int{4, 2, 3, 5, 6, 1}},
+		{name: "labels ignored without LabelPriority", queuePolicy: prcontrollerephemeralenviov1alpha1.QueuePolicyOldestFirst, priorityLabels: []string{"urgent"}, expected: []int{4, 2, 3, 5, 6, 1}},
+		{name: "label priority", queuePolicy: prcontrollerephemeralenviov1alpha1.QueuePolicyLabelPriority, priorityLabels: []string{"urgent", "low"}, expected: []int{3, 5, 2, 4, 6, 1}},
+		{name: "label priority without labels", queuePolicy: prcontrollerephemeralenviov1alpha1.QueuePolicyLabelPriority, expected: []int{4, 2, 3, 5, 6, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sorted := append([]PRDetails{}, prs...)
+			sortQueue(sorted, tc.queuePolicy, tc.priorityLabels)
+			var numbers []int
+			for _, pr := range sorted {
+				numbers = append(numbers, pr.Number)
+			}
+			if !reflect.DeepEqual(numbers, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, numbers)
+			}
+		})
+	}
+}
+
+func TestGetQueuedPRs(t *testing.T) {
+	deleting := metav1.NewTime(queueTestTime)
+	prs := []PRDetails{newQueuedPR(1, 0), newQueuedPR(2, 1), newQueuedPR(3, 2), newQueuedPR(4, 3, "urgent")}
+	for _, tc := range []struct {
+		name            string
+		maxEnvironments int
+		queuePolicy     string
+		helmReleases    []int
+		deleting        []int
+		environments    []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus
+		expected        map[int]int
+	}{
+		{name: "no limit", expected: map[int]int{}},
+		{name: "enough slots", maxEnvironments: 4, expected: map[int]int{}},
+		{name: "PRs with an environment keep it", maxEnvironments: 2, helmReleases: []int{3, 4}, expected: map[int]int{1: 1, 2: 2}},
+		{name: "free slots go to the oldest PRs", maxEnvironments: 3, helmReleases: []int{4}, expected: map[int]int{3: 1}},
+		{name: "label priority", maxEnvironments: 1, queuePolicy: prcontrollerephemeralenviov1alpha1.QueuePolicyLabelPriority, expected: map[int]int{1: 1, 2: 2, 3: 3}},
+		{name: "closed PRs kept for the grace period use a slot", maxEnvironments: 2, helmReleases: []int{1, 99}, expected: map[int]int{2: 1, 3: 2, 4: 3}},
+		{name: "environments being deleted free their slot", maxEnvironments: 2, helmReleases: []int{1, 99}, deleting: []int{99}, expected: map[int]int{3: 1, 4: 2}},
+		{name: "more environments than slots", maxEnvironments: 1, helmReleases: []int{98, 99}, expected: map[int]int{1: 1, 2: 2, 3: 3, 4: 4}},
+		{
+			name:            "expired environments are not queued",
+			maxEnvironments: 1,
+			helmReleases:    []int{1},
+			environments:    []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{{PRNumber: 2, HeadSHA: "sha", Phase: prcontrollerephemeralenviov1alpha1.EnvPhaseExpired}},
+			expected:        map[int]int{3: 1, 4: 2},
+		},
+		{
+			name:            "expired environments are queued after a push",
+			maxEnvironments: 1,
+			helmReleases:    []int{1},
+			environments:    []prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{{PRNumber: 2, HeadSHA: "old-sha", Phase: prcontrollerephemeralenviov1alpha1.EnvPhaseExpired}},
+			expected:        map[int]int{2: 1, 3: 2, 4: 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{}
+			prController.Spec.MaxEnvironments = tc.maxEnvironments
+			prController.Spec.QueuePolicy = tc.queuePolicy
+			prController.Spec.PriorityLabels = []string{"urgent"}
+			prController.Status.Environments = tc.environments
+
+			helmReleases := map[int]fluxhelmrelease.HelmRelease{}
+			for _, prNumber := range tc.helmReleases {
+				helmReleases[prNumber] = fluxhelmrelease.HelmRelease{}
+			}
+			for _, prNumber := range tc.deleting {
+				helmRel := helmReleases[prNumber]
+				helmRel.DeletionTimestamp = &deleting
+				helmReleases[prNumber] = helmRel
+			}
+
+			if queued := getQueuedPRs(prController, prs, helmReleases); !reflect.DeepEqual(queued, tc.expected) {
+				t.Errorf("expected queue positions %v, got %v", tc.expected, queued)
+			}
+		})
+	}
+}
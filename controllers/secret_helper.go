@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	MANAGED_BY_LABEL = "app.kubernetes.io/managed-by"
+	MANAGED_BY_VALUE = "pr-ephemeral-env-controller"
+)
+
+// Validates that the Secrets referenced in valuesFrom are only copied from the namespace of the PREphemeralEnvController,
+// or from one of the namespaces passed, which the operator allowed with the --secret-source-namespaces flag. Otherwise
+// anyone able to create a PREphemeralEnvController could read the Secrets of any namespace
+func ValidateCopySecretsFromNamespace(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, allowedNamespaces []string) error {
+	copyFrom := prController.Spec.EnvCreationHelmRepo.CopySecretsFromNamespace
+	if copyFrom == "" || copyFrom == prController.Namespace {
+		return nil
+	}
+	for _, namespace := range allowedNamespaces {
+		if copyFrom == namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("valuesFrom Secrets can not be copied from the namespace %s, only from the namespace of the PREphemeralEnvController %s or the namespaces allowed with --secret-source-namespaces", copyFrom, prController.Namespace)
+}
+
+// Returns the labels identifying the values Secrets copied by the controller
+func getValuesSecretLabels(prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) map[string]string {
+	return map[string]string{
+		MANAGED_BY_LABEL:           MANAGED_BY_VALUE,
+		CONTROLLER_NAME_LABEL:      prController.Name,
+		CONTROLLER_NAMESPACE_LABEL: prController.Namespace,
+	}
+}
+
+// Copies the Secrets referenced in valuesFrom from the copySecretsFromNamespace to the destination namespace,
+// so that they can be used by Flux for the PR HelmReleases. Secrets which already exist are updated if their data changed.
+// Secrets in the destination namespace which were not created by the controller are left untouched and reported
+func (r *PREphemeralEnvControllerReconciler) CopyValuesFromSecrets(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) error {
+	logger := log.FromContext(ctx)
+	helmRepo := *prController.Spec.EnvCreationHelmRepo
+
+	if helmRepo.CopySecretsFromNamespace == "" || helmRepo.CopySecretsFromNamespace == helmRepo.DestinationNamespace {
+		return nil
+	}
+	labels := getValuesSecretLabels(prController)
+
+	var unmanaged []error
+	for _, ref := range helmRepo.ValuesFrom {
+		if ref.Kind != "Secret" {
+			continue
+		}
+
+		source := &corev1.Secret{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: helmRepo.CopySecretsFromNamespace, Name: ref.Name}, source); err != nil {
+			if apierrors.IsNotFound(err) && ref.Optional {
+				logger.Info("optional values Secret not found, skipping copy", "secret", ref.Name)
+				continue
+			}
+			return fmt.Errorf("unable to fetch values Secret %s/%s: %w", helmRepo.CopySecretsFromNamespace, ref.Name, err)
+		}
+
+		target := &corev1.Secret{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: helmRepo.DestinationNamespace, Name: ref.Name}, target)
+		if apierrors.IsNotFound(err) {
+			target = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      ref.Name,
+					Namespace: helmRepo.DestinationNamespace,
+					Labels:    labels,
+				},
+				Type: source.Type,
+				Data: source.Data,
+			}
+			if err := r.Client.Create(ctx, target); err != nil {
+				return fmt.Errorf("unable to copy values Secret %s: %w", ref.Name, err)
+			}
+			logger.Info("copied values Secret to destination namespace", "secret", ref.Name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to fetch values Secret %s/%s: %w", helmRepo.DestinationNamespace, ref.Name, err)
+		}
+
+		// Secrets copied before they were labeled with the controller are adopted
+		_, hasController := target.Labels[CONTROLLER_NAME_LABEL]
+		if target.Labels[MANAGED_BY_LABEL] != MANAGED_BY_VALUE || (hasController && !isOwnedByController(target, prController)) {
+			unmanaged = append(unmanaged, fmt.Errorf("values Secret %s/%s already exists and is not managed by the controller, it is not overwritten", helmRepo.DestinationNamespace, ref.Name))
+			continue
+		}
+		if hasController && reflect.DeepEqual(target.Data, source.Data) {
+			continue
+		}
+		target.Labels = mergeLabels(target.Labels, labels)
+		target.Data = source.Data
+		if err := r.Client.Update(ctx, target); err != nil {
+			return fmt.Errorf("unable to update values Secret %s: %w", ref.Name, err)
+		}
+		logger.Info("updated values Secret in destination namespace", "secret", ref.Name)
+	}
+
+	return utilerrors.NewAggregate(unmanaged)
+}
+
+// Deletes the values Secrets copied by the controller which are no longer referenced in valuesFrom, nor by any of the
+// HelmReleases passed, which may still reference them until they are updated
+func (r *PREphemeralEnvControllerReconciler) DeleteUnreferencedValuesSecrets(ctx context.Context, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, helmReleases []fluxhelmrelease.HelmRelease) error {
+	logger := log.FromContext(ctx)
+	helmRepo := prController.Spec.EnvCreationHelmRepo
+
+	referenced := map[string]bool{}
+	for _, ref := range helmRepo.ValuesFrom {
+		if ref.Kind == "Secret" {
+			referenced[ref.Name] = true
+		}
+	}
+	for _, helmRel := range helmReleases {
+		for _, ref := range helmRel.Spec.ValuesFrom {
+			if ref.Kind == "Secret" {
+				referenced[ref.Name] = true
+			}
+		}
+	}
+
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(helmRepo.DestinationNamespace), client.MatchingLabels(getValuesSecretLabels(prController))); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if referenced[secret.Name] {
+			continue
+		}
+		if err := r.Delete(ctx, secret); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("unable to delete values Secret %s: %w", secret.Name, err)
+		}
+		logger.Info("deleted values Secret no longer referenced", "secret", secret.Name)
+	}
+	return nil
+}
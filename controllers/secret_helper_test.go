@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newValuesSecret(namespace, name, values string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string][]byte{"values.yaml": []byte(values)},
+	}
+}
+
+func TestValidateCopySecretsFromNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		copyFrom string
+		allowed  []string
+		wantErr  bool
+	}{
+		{name: "not copied"},
+		{name: "namespace of the controller", copyFrom: "shop"},
+		{name: "allowed namespace", copyFrom: "shared", allowed: []string{"shared"}},
+		{name: "other namespace", copyFrom: "kube-system", allowed: []string{"shared"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "shop"}}
+			prController.Spec.EnvCreationHelmRepo = &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{CopySecretsFromNamespace: tc.copyFrom}
+			if err := ValidateCopySecretsFromNamespace(prController, tc.allowed); (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCopyValuesFromSecrets(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "shared"}}
+	outdated := newValuesSecret("envs", "db-credentials", "password: old")
+	outdated.Labels = map[string]string{MANAGED_BY_LABEL: MANAGED_BY_VALUE}
+	copiedByOtherController := newValuesSecret("envs", "db-credentials", "password: other")
+	copiedByOtherController.Labels = getValuesSecretLabels(&prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "blog"}})
+
+	for _, tc := range []struct {
+		name       string
+		copyFrom   string
+		valuesFrom []prcontrollerephemeralenviov1alpha1.ValuesReference
+		existing   []client.Object
+		expected   map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "copied",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "db-credentials"}},
+			expected:   map[string]string{"db-credentials": "password: s3cr3t"},
+		},
+		{
+			name:       "updated when the source changed",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "db-credentials"}},
+			existing:   []client.Object{outdated},
+			expected:   map[string]string{"db-credentials": "password: s3cr3t"},
+		},
+		{
+			name:       "copied by another controller",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "db-credentials"}},
+			existing:   []client.Object{copiedByOtherController},
+			expected:   map[string]string{"db-credentials": "password: other"},
+			wantErr:    true,
+		},
+		{
+			name:       "ConfigMaps are not copied",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "ConfigMap", Name: "db-credentials"}},
+			expected:   map[string]string{},
+		},
+		{
+			name:       "no copySecretsFromNamespace",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "db-credentials"}},
+			expected:   map[string]string{},
+		},
+		{
+			name:       "optional Secret missing",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "feature-flags", Optional: true}},
+			expected:   map[string]string{},
+		},
+		{
+			name:       "required Secret missing",
+			copyFrom:   "shared",
+			valuesFrom: []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "feature-flags"}},
+			expected:   map[string]string{},
+			wantErr:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			objects := append([]client.Object{newValuesSecret("shared", "db-credentials", "password: s3cr3t")}, tc.existing...)
+			r := &PREphemeralEnvControllerReconciler{
+				Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objects...).Build(),
+			}
+			prController.Spec.EnvCreationHelmRepo = &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+				DestinationNamespace:     "envs",
+				CopySecretsFromNamespace: tc.copyFrom,
+				ValuesFrom:               tc.valuesFrom,
+			}
+
+			if err := r.CopyValuesFromSecrets(context.Background(), prController); (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+
+			var secrets corev1.SecretList
+			if err := r.List(context.Background(), &secrets, client.InNamespace("envs")); err != nil {
+				t.Fatal(err)
+			}
+			copied := map[string]string{}
+			for _, secret := range secrets.Items {
+				copied[secret.Name] = string(secret.Data["values.yaml"])
+				if !tc.wantErr && !reflect.DeepEqual(secret.Labels, getValuesSecretLabels(prController)) {
+					t.Errorf("expected the copied Secret %s to be labeled with the controller, got %v", secret.Name, secret.Labels)
+				}
+			}
+			if !reflect.DeepEqual(copied, tc.expected) {
+				t.Errorf("expected the Secrets %v in the destination namespace, got %v", tc.expected, copied)
+			}
+		})
+	}
+}
+
+func TestDeleteUnreferencedValuesSecrets(t *testing.T) {
+	prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "shared"}}
+	prController.Spec.EnvCreationHelmRepo = &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{
+		DestinationNamespace: "envs",
+		ValuesFrom:           []prcontrollerephemeralenviov1alpha1.ValuesReference{{Kind: "Secret", Name: "db-credentials"}},
+	}
+	copied := func(name string) *corev1.Secret {
+		secret := newValuesSecret("envs", name, "")
+		secret.Labels = getValuesSecretLabels(prController)
+		return secret
+	}
+	copiedByOtherController := newValuesSecret("envs", "blog-credentials", "")
+	copiedByOtherController.Labels = getValuesSecretLabels(&prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "ci", Namespace: "blog"}})
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+			copied("db-credentials"),
+			copied("api-keys"),
+			copied("feature-flags"),
+			copiedByOtherController,
+			newValuesSecret("envs", "registry-credentials", ""),
+		).Build(),
+	}
+
+	// The HelmRelease of a PR which was not updated yet still references the api-keys removed from valuesFrom
+	helmReleases := []fluxhelmrelease.HelmRelease{{Spec: fluxhelmrelease.HelmReleaseSpec{
+		ValuesFrom: []fluxhelmrelease.ValuesReference{{Kind: "Secret", Name: "api-keys"}, {Kind: "ConfigMap", Name: "feature-flags"}},
+	}}}
+	if err := r.DeleteUnreferencedValuesSecrets(context.Background(), prController, helmReleases); err != nil {
+		t.Fatal(err)
+	}
+
+	var secrets corev1.SecretList
+	if err := r.List(context.Background(), &secrets, client.InNamespace("envs")); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, secret := range secrets.Items {
+		names = append(names, secret.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"api-keys", "blog-credentials", "db-credentials", "registry-credentials"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the Secrets %v to be left, got %v", expected, names)
+	}
+}
+
+func TestGetFluxValuesReferences(t *testing.T) {
+	refs := []prcontrollerephemeralenviov1alpha1.ValuesReference{
+		{Kind: "Secret", Name: "db-credentials", ValuesKey: "values.yaml", TargetPath: "db", Optional: true},
+		{Kind: "ConfigMap", Name: "defaults"},
+	}
+	fluxRefs := getFluxValuesReferences(refs)
+	if len(fluxRefs) != len(refs) {
+		t.Fatalf("expected %d references, got %+v", len(refs), fluxRefs)
+	}
+	for i, ref := range refs {
+		fluxRef := fluxRefs[i]
+		if fluxRef.Kind != ref.Kind || fluxRef.Name != ref.Name || fluxRef.ValuesKey != ref.ValuesKey || fluxRef.TargetPath != ref.TargetPath || fluxRef.Optional != ref.Optional {
+			t.Errorf("expected %+v to be copied, got %+v", ref, fluxRef)
+		}
+	}
+}
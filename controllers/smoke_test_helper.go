@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	SMOKE_TEST_HOOK               = "smoke-test"
+	SMOKE_TEST_LOG_TAIL_LINES     = 50
+	SMOKE_TEST_LOG_TAIL_MAX_BYTES = 32 * 1024
+	JOB_NAME_LABEL                = "job-name"
+)
+
+// Returns the name of the smoke test Job. The name includes the PR head SHA, so that the smoke test runs again for
+// every new commit of the PR
+func getSmokeTestJobName(helmRel fluxhelmrelease.HelmRelease, prHeadSHA string) string {
+	sha := prHeadSHA
+	if len(sha) > SHORT_SHA_LENGTH {
+		sha = sha[:SHORT_SHA_LENGTH]
+	}
+	return fmt.Sprintf("%s-%s-%s", helmRel.Name, SMOKE_TEST_HOOK, sha)
+}
+
+// Returns the last lines of the log of the most recent Pod of the Job. Pods are listed from the API server instead of
+// the cache, so that the controller does not watch every Pod of the cluster
+func (r *PREphemeralEnvControllerReconciler) getJobLogTail(ctx context.Context, namespace string, jobName string) (string, error) {
+	if r.Config == nil {
+		return "", fmt.Errorf("no Kubernetes API server config to fetch the logs of Job %s", jobName)
+	}
+	clientset, err := kubernetes.NewForConfig(r.Config)
+	if err != nil {
+		return "", err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{JOB_NAME_LABEL: jobName})
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", fmt.Errorf("unable to list the Pods of Job %s: %w", jobName, err)
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("no Pods found for Job %s", jobName)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[j].CreationTimestamp.Before(&pods.Items[i].CreationTimestamp)
+	})
+
+	tailLines := int64(SMOKE_TEST_LOG_TAIL_LINES)
+	limitBytes := int64(SMOKE_TEST_LOG_TAIL_MAX_BYTES)
+	logs, err := clientset.CoreV1().Pods(namespace).GetLogs(pods.Items[0].Name, &corev1.PodLogOptions{TailLines: &tailLines, LimitBytes: &limitBytes}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch the logs of Pod %s: %w", pods.Items[0].Name, err)
+	}
+	return string(logs), nil
+}
+
+// Comments on the PR with the tail of the log of the failed smoke test Job
+func (r *PREphemeralEnvControllerReconciler) reportSmokeTestFailure(ctx context.Context, jobName string, result string, prDetails PRDetails, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) {
+	logger := log.FromContext(ctx)
+
+	comment := fmt.Sprintf("The smoke test of the ephemeral environment for commit %s finished with result **%s**.", prDetails.HeadSHA, result)
+	logTail, err := r.getJobLogTail(ctx, prController.Spec.EnvCreationHelmRepo.DestinationNamespace, jobName)
+	if err != nil {
+		logger.Error(err, "unable to fetch the log of the smoke test Job", "job", jobName)
+	} else if logTail != "" {
+		comment += fmt.Sprintf("\n\nLast %d lines of the log of Job `%s`:\n\n```\n%s\n```", SMOKE_TEST_LOG_TAIL_LINES, jobName, strings.TrimRight(logTail, "\n"))
+	}
+	if err := r.CreatePRComment(ctx, prDetails.Number, comment); err != nil {
+		logger.Error(err, "unable to comment the smoke test log on the PR", "prNumber", prDetails.Number)
+	}
+}
+
+// Runs the smoke test Job against the environment of the PR once its health checks pass. Returns true once the smoke
+// test succeeded for the PR head SHA, or if no smoke test is configured. The log of a failed smoke test is commented
+// on the PR
+func (r *PREphemeralEnvControllerReconciler) RunSmokeTest(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, envStatus *prcontrollerephemeralenviov1alpha1.PREnvironmentStatus, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController, now metav1.Time) bool {
+	logger := log.FromContext(ctx)
+
+	smokeTest := prController.Spec.SmokeTest
+	if smokeTest == nil || envStatus.SmokeTest == prcontrollerephemeralenviov1alpha1.HookResultSucceeded {
+		return true
+	}
+	if envStatus.SmokeTest != "" && envStatus.SmokeTest != prcontrollerephemeralenviov1alpha1.HookResultRunning {
+		return false
+	}
+
+	if envStatus.SmokeTestStartedAt == nil {
+		envStatus.SmokeTestStartedAt = &now
+	}
+	jobName := getSmokeTestJobName(helmRel, prDetails.HeadSHA)
+	result, err := r.RunHookJob(ctx, SMOKE_TEST_HOOK, jobName, smokeTest, helmRel, prDetails, prController, *envStatus.SmokeTestStartedAt, now)
+	if err != nil {
+		mesg := fmt.Sprintf("unable to run smoke test for PR %d", prDetails.Number)
+		r.Record.Event(prController, "Warning", "HookFailed", mesg)
+		logger.Error(err, mesg)
+		return false
+	}
+	envStatus.SmokeTest = result
+
+	switch result {
+	case prcontrollerephemeralenviov1alpha1.HookResultSucceeded:
+		return true
+	case prcontrollerephemeralenviov1alpha1.HookResultFailed, prcontrollerephemeralenviov1alpha1.HookResultTimedOut:
+		envStatus.Message = fmt.Sprintf("Smoke test Job %s finished with result %s", jobName, result)
+		r.reportSmokeTestFailure(ctx, jobName, result, prDetails, prController)
+		// The log is commented before a timed out Job is deleted along with its Pods
+		if result == prcontrollerephemeralenviov1alpha1.HookResultTimedOut {
+			r.deleteHookJob(ctx, prController, jobName)
+		}
+	}
+	return false
+}
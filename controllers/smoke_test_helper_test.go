@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetSmokeTestJobName(t *testing.T) {
+	helmRel := fluxhelmrelease.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "relpr-42"}}
+	if name := getSmokeTestJobName(helmRel, "a1b2c3d4e5f6a7b8"); name != "relpr-42-smoke-test-a1b2c3d" {
+		t.Errorf("expected the Job name to end with the short head SHA, got %s", name)
+	}
+	if getSmokeTestJobName(helmRel, "9f8e7d6c5b4a3210") == getSmokeTestJobName(helmRel, "a1b2c3d4e5f6a7b8") {
+		t.Error("expected a new commit to run the smoke test in a new Job")
+	}
+}
+
+func TestRunSmokeTest(t *testing.T) {
+	helmRel := fluxhelmrelease.HelmRelease{ObjectMeta: metav1.ObjectMeta{Name: "relpr-42", Namespace: "envs"}}
+	startedAt := metav1.NewTime(time.Date(2022, 10, 7, 16, 0, 0, 0, time.UTC))
+	runningJob := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Name:              getSmokeTestJobName(helmRel, testPRDetails.HeadSHA),
+		Namespace:         "envs",
+		CreationTimestamp: startedAt,
+	}}
+
+	for _, tc := range []struct {
+		name      string
+		smokeTest *prcontrollerephemeralenviov1alpha1.HookJob
+		previous  string
+		expected  bool
+		result    string
+	}{
+		{name: "no smoke test", expected: true},
+		{name: "succeeded for the head SHA", smokeTest: &prcontrollerephemeralenviov1alpha1.HookJob{}, previous: prcontrollerephemeralenviov1alpha1.HookResultSucceeded, expected: true, result: prcontrollerephemeralenviov1alpha1.HookResultSucceeded},
+		{name: "failed for the head SHA", smokeTest: &prcontrollerephemeralenviov1alpha1.HookJob{}, previous: prcontrollerephemeralenviov1alpha1.HookResultFailed, result: prcontrollerephemeralenviov1alpha1.HookResultFailed},
+		{name: "running", smokeTest: &prcontrollerephemeralenviov1alpha1.HookJob{}, previous: prcontrollerephemeralenviov1alpha1.HookResultRunning, result: prcontrollerephemeralenviov1alpha1.HookResultRunning},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prController := &prcontrollerephemeralenviov1alpha1.PREphemeralEnvController{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "ci"}}
+			prController.Spec.EnvCreationHelmRepo = &prcontrollerephemeralenviov1alpha1.EnvCreationHelmRepo{DestinationNamespace: "envs"}
+			prController.Spec.SmokeTest = tc.smokeTest
+			r := &PREphemeralEnvControllerReconciler{
+				Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(runningJob.DeepCopy()).Build(),
+				Record: record.NewFakeRecorder(10),
+			}
+			envStatus := &prcontrollerephemeralenviov1alpha1.PREnvironmentStatus{SmokeTest: tc.previous}
+
+			now := metav1.NewTime(startedAt.Add(time.Minute))
+			if passed := r.RunSmokeTest(context.Background(), helmRel, testPRDetails, envStatus, prController, now); passed != tc.expected {
+				t.Errorf("expected the smoke test to pass %v, got %v", tc.expected, passed)
+			}
+			if envStatus.SmokeTest != tc.result {
+				t.Errorf("expected the smoke test result %q, got %q", tc.result, envStatus.SmokeTest)
+			}
+		})
+	}
+}
+
+func TestGetJobLogTailWithoutConfig(t *testing.T) {
+	r := &PREphemeralEnvControllerReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()}
+	if _, err := r.getJobLogTail(context.Background(), "envs", "relpr-42-smoke-test-a1b2c3d"); err == nil {
+		t.Error("expected an error without a Kubernetes API server config")
+	}
+}
+
+func TestGetJobLogTail(t *testing.T) {
+	startedAt := metav1.NewTime(time.Date(2022, 10, 7, 16, 0, 0, 0, time.UTC))
+	selectors := make(chan string, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/namespaces/envs/pods":
+			selectors <- req.URL.Query().Get("labelSelector")
+			w.Header().Set("Content-Type", "application/json")
+			// The retried Pod is the most recent one
+			_ = json.NewEncoder(w).Encode(corev1.PodList{Items: []corev1.Pod{
+				{ObjectMeta: metav1.ObjectMeta{Name: "smoke-test-first", Namespace: "envs", CreationTimestamp: startedAt}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "smoke-test-retry", Namespace: "envs", CreationTimestamp: metav1.NewTime(startedAt.Add(time.Minute))}},
+			}})
+		case "/api/v1/namespaces/envs/pods/smoke-test-retry/log":
+			_, _ = w.Write([]byte("checkout: expected 200, got 502\n"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer apiServer.Close()
+
+	r := &PREphemeralEnvControllerReconciler{Config: &rest.Config{Host: apiServer.URL}}
+	logTail, err := r.getJobLogTail(context.Background(), "envs", "relpr-42-smoke-test-a1b2c3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logTail != "checkout: expected 200, got 502\n" {
+		t.Errorf("expected the log of the most recent Pod, got %q", logTail)
+	}
+	if selector := <-selectors; selector != "job-name=relpr-42-smoke-test-a1b2c3d" {
+		t.Errorf("expected the Pods to be listed by Job name, got the selector %q", selector)
+	}
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	HELM_RELEASE_INSTANCE_LABEL   = "app.kubernetes.io/instance"
+	VOLUME_SNAPSHOT_RETAIN_POLICY = "Retain"
+)
+
+var (
+	volumeSnapshotGVK        = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+	volumeSnapshotContentGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshotContent"}
+)
+
+// Returns the teardown policy for the outcome of a PR which is no longer open, defaulting to the Delete action
+func getTeardownPolicy(spec prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec, outcome string) prcontrollerephemeralenviov1alpha1.TeardownPolicy {
+	policy := spec.OnClosed
+	if outcome == prcontrollerephemeralenviov1alpha1.PROutcomeMerged {
+		policy = spec.OnMerged
+	}
+	if policy == nil || policy.Action == "" {
+		return prcontrollerephemeralenviov1alpha1.TeardownPolicy{Action: prcontrollerephemeralenviov1alpha1.TeardownActionDelete}
+	}
+	return *policy
+}
+
+// Returns the name of the VolumeSnapshot of the PersistentVolumeClaim, unique to the PR, its head SHA and the time
+// it was closed, so that a PR which is reopened and closed again gets new snapshots
+func getVolumeSnapshotName(pvcName string, prDetails PRDetails, closedAt metav1.Time) string {
+	sha := prDetails.HeadSHA
+	if len(sha) > SHORT_SHA_LENGTH {
+		sha = sha[:SHORT_SHA_LENGTH]
+	}
+	return fmt.Sprintf("%s-pr%d-%s-%d", pvcName, prDetails.Number, sha, closedAt.Unix())
+}
+
+// Creates a VolumeSnapshot for each PersistentVolumeClaim of the Helm release of the PR, and returns true once all of
+// them are ready to use. The PersistentVolumeClaims of the release are found by their Helm release annotation or
+// app.kubernetes.io/instance label. VolumeSnapshots are not deleted by the controller. Snapshots of claims outside
+// the namespace of the HelmRelease, like claims in the namespace of the PR which is deleted with the environment, are
+// retained and bound to a VolumeSnapshot in the namespace of the HelmRelease
+func (r *PREphemeralEnvControllerReconciler) SnapshotPRVolumes(ctx context.Context, helmRel fluxhelmrelease.HelmRelease, prDetails PRDetails, closedAt metav1.Time, policy prcontrollerephemeralenviov1alpha1.TeardownPolicy, prController *prcontrollerephemeralenviov1alpha1.PREphemeralEnvController) (bool, error) {
+	namespace := helmRel.Spec.TargetNamespace
+	if namespace == "" {
+		namespace = helmRel.Namespace
+	}
+	releaseName := helmRel.Spec.ReleaseName
+	if releaseName == "" {
+		releaseName = helmRel.Name
+	}
+
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := r.List(ctx, &pvcs, client.InNamespace(namespace)); err != nil {
+		return false, err
+	}
+
+	labels := getPRLabels(prController, prDetails.Number)
+	ready := true
+	for _, pvc := range pvcs.Items {
+		if pvc.Annotations[HELM_RELEASE_NAME_ANNOTATION] != releaseName && pvc.Labels[HELM_RELEASE_INSTANCE_LABEL] != releaseName {
+			continue
+		}
+
+		snapshotName := getVolumeSnapshotName(pvc.Name, prDetails, closedAt)
+		source := map[string]interface{}{"persistentVolumeClaimName": pvc.Name}
+		snapshot, err := r.ensureVolumeSnapshot(ctx, namespace, snapshotName, labels, source, policy.VolumeSnapshotClassName)
+		if err != nil {
+			return false, err
+		}
+		if !isVolumeSnapshotReady(snapshot) {
+			ready = false
+			continue
+		}
+		if namespace == helmRel.Namespace {
+			continue
+		}
+
+		retained, err := r.retainVolumeSnapshot(ctx, snapshot, helmRel.Namespace, labels, policy.VolumeSnapshotClassName)
+		if err != nil {
+			return false, err
+		}
+		if !retained {
+			ready = false
+		}
+	}
+
+	return ready, nil
+}
+
+// Returns the VolumeSnapshot, creating it from the source passed if it does not exist
+func (r *PREphemeralEnvControllerReconciler) ensureVolumeSnapshot(ctx context.Context, namespace string, name string, labels map[string]string, source map[string]interface{}, className string) (*unstructured.Unstructured, error) {
+	logger := log.FromContext(ctx)
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, snapshot)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return snapshot, err
+	}
+
+	snapshot.SetName(name)
+	snapshot.SetNamespace(namespace)
+	snapshot.SetLabels(labels)
+	if err := unstructured.SetNestedMap(snapshot.Object, source, "spec", "source"); err != nil {
+		return nil, err
+	}
+	if className != "" {
+		if err := unstructured.SetNestedField(snapshot.Object, className, "spec", "volumeSnapshotClassName"); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.Create(ctx, snapshot); err != nil {
+		return nil, fmt.Errorf("unable to create VolumeSnapshot %s/%s: %w", namespace, name, err)
+	}
+	logger.Info("created VolumeSnapshot", "volumeSnapshot", name, "namespace", namespace)
+	return snapshot, nil
+}
+
+func isVolumeSnapshotReady(snapshot *unstructured.Unstructured) bool {
+	readyToUse, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return readyToUse
+}
+
+// Keeps the content of a ready VolumeSnapshot once the snapshot is deleted, by setting the deletionPolicy of its
+// VolumeSnapshotContent to Retain, and binds the content to a VolumeSnapshot of the same name in the namespace passed.
+// Returns true once that VolumeSnapshot is ready to use
+func (r *PREphemeralEnvControllerReconciler) retainVolumeSnapshot(ctx context.Context, snapshot *unstructured.Unstructured, namespace string, labels map[string]string, className string) (bool, error) {
+	contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+	if contentName == "" {
+		return false, nil
+	}
+	content := &unstructured.Unstructured{}
+	content.SetGroupVersionKind(volumeSnapshotContentGVK)
+	if err := r.Get(ctx, types.NamespacedName{Name: contentName}, content); err != nil {
+		return false, err
+	}
+	deletionPolicy, _, _ := unstructured.NestedString(content.Object, "spec", "deletionPolicy")
+	if deletionPolicy != VOLUME_SNAPSHOT_RETAIN_POLICY {
+		patch := client.MergeFrom(content.DeepCopy())
+		if err := unstructured.SetNestedField(content.Object, VOLUME_SNAPSHOT_RETAIN_POLICY, "spec", "deletionPolicy"); err != nil {
+			return false, err
+		}
+		if err := r.Patch(ctx, content, patch); err != nil {
+			return false, fmt.Errorf("unable to retain VolumeSnapshotContent %s: %w", contentName, err)
+		}
+	}
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+	snapshotHandle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+	if snapshotHandle == "" {
+		return false, nil
+	}
+
+	// Pre-provisioned content bound to the VolumeSnapshot in the namespace passed
+	retainedName := fmt.Sprintf("%s-%s", namespace, snapshot.GetName())
+	retained := &unstructured.Unstructured{}
+	retained.SetGroupVersionKind(volumeSnapshotContentGVK)
+	retained.SetName(retainedName)
+	retained.SetLabels(labels)
+	spec := map[string]interface{}{
+		"deletionPolicy": VOLUME_SNAPSHOT_RETAIN_POLICY,
+		"driver":         driver,
+		"source":         map[string]interface{}{"snapshotHandle": snapshotHandle},
+		"volumeSnapshotRef": map[string]interface{}{
+			"name":      snapshot.GetName(),
+			"namespace": namespace,
+		},
+	}
+	if className != "" {
+		spec["volumeSnapshotClassName"] = className
+	}
+	if err := unstructured.SetNestedMap(retained.Object, spec, "spec"); err != nil {
+		return false, err
+	}
+	if err := r.Create(ctx, retained); err != nil && !apierrors.IsAlreadyExists(err) {
+		return false, fmt.Errorf("unable to create VolumeSnapshotContent %s: %w", retainedName, err)
+	}
+
+	source := map[string]interface{}{"volumeSnapshotContentName": retainedName}
+	copied, err := r.ensureVolumeSnapshot(ctx, namespace, snapshot.GetName(), labels, source, className)
+	if err != nil {
+		return false, err
+	}
+	return isVolumeSnapshotReady(copied), nil
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetTeardownPolicy(t *testing.T) {
+	snapshot := &prcontrollerephemeralenviov1alpha1.TeardownPolicy{
+		Action:                  prcontrollerephemeralenviov1alpha1.TeardownActionSnapshotThenDelete,
+		VolumeSnapshotClassName: "csi",
+	}
+	retain := &prcontrollerephemeralenviov1alpha1.TeardownPolicy{Action: prcontrollerephemeralenviov1alpha1.TeardownActionRetain}
+
+	for _, tc := range []struct {
+		name     string
+		onMerged *prcontrollerephemeralenviov1alpha1.TeardownPolicy
+		onClosed *prcontrollerephemeralenviov1alpha1.TeardownPolicy
+		outcome  string
+		expected string
+	}{
+		{name: "no policies", outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, expected: prcontrollerephemeralenviov1alpha1.TeardownActionDelete},
+		{name: "merged PR", onMerged: snapshot, onClosed: retain, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, expected: prcontrollerephemeralenviov1alpha1.TeardownActionSnapshotThenDelete},
+		{name: "closed PR", onMerged: snapshot, onClosed: retain, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeClosed, expected: prcontrollerephemeralenviov1alpha1.TeardownActionRetain},
+		{name: "merged PR without onMerged", onClosed: retain, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeMerged, expected: prcontrollerephemeralenviov1alpha1.TeardownActionDelete},
+		{name: "policy without action", onClosed: &prcontrollerephemeralenviov1alpha1.TeardownPolicy{VolumeSnapshotClassName: "csi"}, outcome: prcontrollerephemeralenviov1alpha1.PROutcomeClosed, expected: prcontrollerephemeralenviov1alpha1.TeardownActionDelete},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{OnMerged: tc.onMerged, OnClosed: tc.onClosed}
+			if policy := getTeardownPolicy(spec, tc.outcome); policy.Action != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, policy.Action)
+			}
+		})
+	}
+
+	spec := prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerSpec{OnMerged: snapshot}
+	if policy := getTeardownPolicy(spec, prcontrollerephemeralenviov1alpha1.PROutcomeMerged); policy.VolumeSnapshotClassName != "csi" {
+		t.Errorf("expected the VolumeSnapshotClass of the policy, got %q", policy.VolumeSnapshotClassName)
+	}
+}
+
+func TestGetVolumeSnapshotName(t *testing.T) {
+	closedAt := metav1.NewTime(time.Unix(1664582400, 0))
+	if name := getVolumeSnapshotName("data", testPRDetails, closedAt); name != "data-pr42-a1b2c3d-1664582400" {
+		t.Errorf("unexpected VolumeSnapshot name %s", name)
+	}
+	if name := getVolumeSnapshotName("data", PRDetails{Number: 7, HeadSHA: "abc"}, closedAt); name != "data-pr7-abc-1664582400" {
+		t.Errorf("unexpected VolumeSnapshot name for a short SHA %s", name)
+	}
+	reclosedAt := metav1.NewTime(closedAt.Add(time.Hour))
+	if getVolumeSnapshotName("data", testPRDetails, closedAt) == getVolumeSnapshotName("data", testPRDetails, reclosedAt) {
+		t.Error("expected a PR closed again to get a new VolumeSnapshot name")
+	}
+}
+
+func getTestVolumeSnapshot(t *testing.T, r *PREphemeralEnvControllerReconciler, namespace string, name string) *unstructured.Unstructured {
+	t.Helper()
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, snapshot); err != nil {
+		t.Fatalf("VolumeSnapshot %s/%s: %v", namespace, name, err)
+	}
+	return snapshot
+}
+
+// Sets the status the snapshot controller reports on a VolumeSnapshot
+func setTestVolumeSnapshotStatus(t *testing.T, r *PREphemeralEnvControllerReconciler, snapshot *unstructured.Unstructured, status map[string]interface{}) {
+	t.Helper()
+	if err := unstructured.SetNestedMap(snapshot.Object, status, "status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotPRVolumes(t *testing.T) {
+	ctx := context.Background()
+	prController, _ := newTestPRController("app")
+	prDetails := PRDetails{Number: 1, HeadSHA: "sha1234567"}
+	closedAt := metav1.NewTime(time.Unix(1664582400, 0))
+	policy := prcontrollerephemeralenviov1alpha1.TeardownPolicy{
+		Action:                  prcontrollerephemeralenviov1alpha1.TeardownActionSnapshotThenDelete,
+		VolumeSnapshotClassName: "csi",
+	}
+	pvcs := []client.Object{
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "pr-1", Annotations: map[string]string{HELM_RELEASE_NAME_ANNOTATION: "pr-1"}}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "pr-1", Labels: map[string]string{HELM_RELEASE_INSTANCE_LABEL: "pr-1"}}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "pr-1", Labels: map[string]string{HELM_RELEASE_INSTANCE_LABEL: "pr-2"}}},
+	}
+
+	t.Run("same namespace", func(t *testing.T) {
+		r := &PREphemeralEnvControllerReconciler{Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(pvcs...).Build()}
+		helmRel := fluxhelmrelease.HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-1", Namespace: "pr-1"},
+			Spec:       fluxhelmrelease.HelmReleaseSpec{ReleaseName: "pr-1"},
+		}
+
+		ready, err := r.SnapshotPRVolumes(ctx, helmRel, prDetails, closedAt, policy, prController)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ready {
+			t.Fatal("expected the snapshots not to be ready once created")
+		}
+
+		var snapshots unstructured.UnstructuredList
+		snapshots.SetGroupVersionKind(volumeSnapshotGVK)
+		if err := r.List(ctx, &snapshots, client.InNamespace("pr-1")); err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots.Items) != 2 {
+			t.Fatalf("expected a VolumeSnapshot for each PersistentVolumeClaim of the release, got %d", len(snapshots.Items))
+		}
+		for _, pvcName := range []string{"data", "cache"} {
+			snapshot := getTestVolumeSnapshot(t, r, "pr-1", getVolumeSnapshotName(pvcName, prDetails, closedAt))
+			if source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName"); source != pvcName {
+				t.Errorf("expected the VolumeSnapshot of %s to be taken from it, got %q", pvcName, source)
+			}
+			if className, _, _ := unstructured.NestedString(snapshot.Object, "spec", "volumeSnapshotClassName"); className != "csi" {
+				t.Errorf("expected the VolumeSnapshotClass of the policy, got %q", className)
+			}
+			if snapshot.GetLabels()[PR_NUMBER_LABEL] != "1" {
+				t.Errorf("expected the VolumeSnapshot to be labelled with the PR, got %v", snapshot.GetLabels())
+			}
+			setTestVolumeSnapshotStatus(t, r, snapshot, map[string]interface{}{"readyToUse": true})
+		}
+
+		ready, err = r.SnapshotPRVolumes(ctx, helmRel, prDetails, closedAt, policy, prController)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ready {
+			t.Error("expected the snapshots to be ready")
+		}
+	})
+
+	t.Run("namespace of the PR", func(t *testing.T) {
+		content := &unstructured.Unstructured{}
+		content.SetGroupVersionKind(volumeSnapshotContentGVK)
+		content.SetName("snapcontent-data")
+		content.Object["spec"] = map[string]interface{}{"deletionPolicy": "Delete", "driver": "disk.csi.example.com"}
+		content.Object["status"] = map[string]interface{}{"snapshotHandle": "handle-data"}
+		r := &PREphemeralEnvControllerReconciler{Client: fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(append(pvcs[:1:1], content)...).Build()}
+		helmRel := fluxhelmrelease.HelmRelease{
+			ObjectMeta: metav1.ObjectMeta{Name: "pr-1", Namespace: "envs-app"},
+			Spec:       fluxhelmrelease.HelmReleaseSpec{ReleaseName: "pr-1", TargetNamespace: "pr-1"},
+		}
+		snapshotName := getVolumeSnapshotName("data", prDetails, closedAt)
+
+		if ready, err := r.SnapshotPRVolumes(ctx, helmRel, prDetails, closedAt, policy, prController); err != nil || ready {
+			t.Fatalf("expected the snapshot not to be ready once created, got %t, %v", ready, err)
+		}
+		snapshot := getTestVolumeSnapshot(t, r, "pr-1", snapshotName)
+		setTestVolumeSnapshotStatus(t, r, snapshot, map[string]interface{}{"readyToUse": true, "boundVolumeSnapshotContentName": "snapcontent-data"})
+
+		// The content of the snapshot is retained and bound to a VolumeSnapshot in the namespace of the HelmRelease
+		if ready, err := r.SnapshotPRVolumes(ctx, helmRel, prDetails, closedAt, policy, prController); err != nil || ready {
+			t.Fatalf("expected the retained snapshot not to be ready once created, got %t, %v", ready, err)
+		}
+		if err := r.Get(ctx, types.NamespacedName{Name: "snapcontent-data"}, content); err != nil {
+			t.Fatal(err)
+		}
+		if deletionPolicy, _, _ := unstructured.NestedString(content.Object, "spec", "deletionPolicy"); deletionPolicy != VOLUME_SNAPSHOT_RETAIN_POLICY {
+			t.Errorf("expected the VolumeSnapshotContent to be retained, got deletionPolicy %q", deletionPolicy)
+		}
+
+		retained := &unstructured.Unstructured{}
+		retained.SetGroupVersionKind(volumeSnapshotContentGVK)
+		if err := r.Get(ctx, types.NamespacedName{Name: "envs-app-" + snapshotName}, retained); err != nil {
+			t.Fatalf("expected a pre-provisioned VolumeSnapshotContent: %v", err)
+		}
+		for _, field := range []struct {
+			path     []string
+			expected string
+		}{
+			{path: []string{"spec", "deletionPolicy"}, expected: VOLUME_SNAPSHOT_RETAIN_POLICY},
+			{path: []string{"spec", "driver"}, expected: "disk.csi.example.com"},
+			{path: []string{"spec", "source", "snapshotHandle"}, expected: "handle-data"},
+			{path: []string{"spec", "volumeSnapshotRef", "name"}, expected: snapshotName},
+			{path: []string{"spec", "volumeSnapshotRef", "namespace"}, expected: "envs-app"},
+			{path: []string{"spec", "volumeSnapshotClassName"}, expected: "csi"},
+		} {
+			if value, _, _ := unstructured.NestedString(retained.Object, field.path...); value != field.expected {
+				t.Errorf("expected %v of the pre-provisioned VolumeSnapshotContent to be %q, got %q", field.path, field.expected, value)
+			}
+		}
+
+		copied := getTestVolumeSnapshot(t, r, "envs-app", snapshotName)
+		if source, _, _ := unstructured.NestedString(copied.Object, "spec", "source", "volumeSnapshotContentName"); source != "envs-app-"+snapshotName {
+			t.Errorf("expected the VolumeSnapshot to be bound to the pre-provisioned content, got %q", source)
+		}
+		setTestVolumeSnapshotStatus(t, r, copied, map[string]interface{}{"readyToUse": true})
+
+		ready, err := r.SnapshotPRVolumes(ctx, helmRel, prDetails, closedAt, policy, prController)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ready {
+			t.Error("expected the retained snapshot to be ready")
+		}
+	})
+}
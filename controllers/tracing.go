@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME          = "github.com/manisbindra/pr-ephemeral-env-controller/controllers"
+	TRACING_SERVICE_NAME = "pr-ephemeral-env-controller"
+)
+
+// Span attribute keys
+const (
+	PR_NUMBER_ATTRIBUTE    = attribute.Key("pr.number")
+	PR_HEAD_SHA_ATTRIBUTE  = attribute.Key("pr.head_sha")
+	CONTROLLER_ATTRIBUTE   = attribute.Key("prephemeralenvcontroller")
+	HEALTH_CHECK_ATTRIBUTE = attribute.Key("health_check")
+)
+
+// Creates a tracer provider exporting spans over OTLP gRPC to the endpoint passed. The returned provider must be shut
+// down to flush the remaining spans
+func NewOTLPTracerProvider(ctx context.Context, endpoint string, insecure bool, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(TRACING_SERVICE_NAME))),
+	), nil
+}
+
+// Returns the span start option tagging a span with the PR number and head SHA
+func withPRAttributes(prNumber int, prHeadSHA string) trace.SpanStartOption {
+	return trace.WithAttributes(PR_NUMBER_ATTRIBUTE.Int(prNumber), PR_HEAD_SHA_ATTRIBUTE.String(prHeadSHA))
+}
+
+// Starts a span with the tracer provider of the reconciler, or with the global tracer provider if none is set, like
+// an SDK tracer provider with an in-memory exporter in tests
+func (r *PREphemeralEnvControllerReconciler) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tracerProvider := r.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	return tracerProvider.Tracer(TRACER_NAME).Start(ctx, name, opts...)
+}
+
+// Ends the span, recording the error passed if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
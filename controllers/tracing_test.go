@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// prGithub serves a single PR, number 1, whose head SHA and state can be changed between reconciles
+type prGithub struct {
+	mu      sync.Mutex
+	headSHA string
+	state   string
+}
+
+func (g *prGithub) set(headSHA string, state string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.headSHA, g.state = headSHA, state
+}
+
+func (g *prGithub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pr := map[string]interface{}{
+		"number":    1,
+		"state":     g.state,
+		"head":      map[string]interface{}{"sha": g.headSHA, "ref": "feature"},
+		"closed_at": "2022-10-01T00:00:00Z",
+	}
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/pulls"):
+		prs := []map[string]interface{}{}
+		if g.state == "open" {
+			prs = append(prs, pr)
+		}
+		_ = json.NewEncoder(w).Encode(prs)
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/pulls/1"):
+		_ = json.NewEncoder(w).Encode(pr)
+	case req.Method == http.MethodPost && strings.Contains(req.URL.Path, "/statuses/"):
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Returns the attributes of the span as a map of strings
+func spanAttributes(span tracetest.SpanStub) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range span.Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	return attrs
+}
+
+// Reconciles a PR through its creation, update and deletion, and checks the spans recorded for each reconcile
+func TestReconcileSpans(t *testing.T) {
+	github := &prGithub{}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	defaultGHClients := ghClients
+	ghClients = newGHClientCache(redirectTransport{target: target})
+	defer func() { ghClients = defaultGHClients }()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = tracerProvider.Shutdown(context.Background()) }()
+
+	scheme := newTestScheme(t)
+	prController, secret := newTestPRController("app")
+	r := &PREphemeralEnvControllerReconciler{
+		Client:         fake.NewClientBuilder().WithScheme(scheme).WithObjects(prController, secret).Build(),
+		Scheme:         scheme,
+		Record:         &record.FakeRecorder{},
+		Prober:         NewHealthProber(1),
+		TracerProvider: tracerProvider,
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+
+	for _, step := range []struct {
+		name     string
+		headSHA  string
+		state    string
+		children []string
+	}{
+		{name: "create", headSHA: "sha-1", state: "open", children: []string{"CreateFluxHelmRelease", "UpdatePRStatus"}},
+		{name: "update", headSHA: "sha-2", state: "open", children: []string{"UpdateFluxHelmRelease"}},
+		{name: "delete", headSHA: "sha-2", state: "closed", children: []string{"DeleteFluxHelmRelease"}},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			exporter.Reset()
+			github.set(step.headSHA, step.state)
+			if _, err := r.Reconcile(context.Background(), req); err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				if _, ok := spans[span.Name]; !ok {
+					spans[span.Name] = span
+				}
+			}
+			root, ok := spans["Reconcile"]
+			if !ok {
+				t.Fatalf("no Reconcile span recorded, got %v", spans)
+			}
+			if root.Parent.IsValid() {
+				t.Errorf("Reconcile span has parent %s", root.Parent.SpanID())
+			}
+			if controller := spanAttributes(root)[string(CONTROLLER_ATTRIBUTE)]; controller != req.String() {
+				t.Errorf("Reconcile span has controller attribute %q", controller)
+			}
+
+			for _, name := range append([]string{"GetActivePullRequests"}, step.children...) {
+				span, ok := spans[name]
+				if !ok {
+					t.Errorf("no %s span recorded", name)
+					continue
+				}
+				if span.Parent.SpanID() != root.SpanContext.SpanID() || span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+					t.Errorf("%s span is not a child of the Reconcile span", name)
+				}
+				if name == "GetActivePullRequests" {
+					continue
+				}
+				attrs := spanAttributes(span)
+				if attrs[string(PR_NUMBER_ATTRIBUTE)] != "1" || attrs[string(PR_HEAD_SHA_ATTRIBUTE)] != step.headSHA {
+					t.Errorf("%s span has PR attributes %v, expected PR 1 at %s", name, attrs, step.headSHA)
+				}
+			}
+		})
+	}
+
+	var helmReleases fluxhelmrelease.HelmReleaseList
+	if err := r.List(context.Background(), &helmReleases, client.InNamespace("envs-app")); err != nil {
+		t.Fatal(err)
+	}
+	if len(helmReleases.Items) != 0 {
+		t.Errorf("expected the HelmRelease of the closed PR to be deleted, got %d HelmReleases", len(helmReleases.Items))
+	}
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	fluxmeta "github.com/fluxcd/pkg/apis/meta"
+	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Returns the reconcile request of the PREphemeralEnvController which created the object, as recorded in its labels
+func getOwnerRequests(obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	name, namespace := labels[CONTROLLER_NAME_LABEL], labels[CONTROLLER_NAMESPACE_LABEL]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}}
+}
+
+// Maps a HelmRelease to the PREphemeralEnvController which created it. HelmReleases created before they were
+// labeled are mapped to the PREphemeralEnvControllers whose destinationNamespace they are in
+func (r *PREphemeralEnvControllerReconciler) mapHelmReleaseToPRController(obj client.Object) []reconcile.Request {
+	if requests := getOwnerRequests(obj); requests != nil {
+		return requests
+	}
+	if !strings.HasPrefix(obj.GetName(), FLUX_HELM_RELEASE_PREFIX) {
+		return nil
+	}
+
+	var prControllers prcontrollerephemeralenviov1alpha1.PREphemeralEnvControllerList
+	if err := r.List(context.Background(), &prControllers); err != nil {
+		log.Log.Error(err, "unable to list PRControllers for HelmRelease", "helmRelease", client.ObjectKeyFromObject(obj))
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, prController := range prControllers.Items {
+		helmRepo := prController.Spec.EnvCreationHelmRepo
+		if helmRepo != nil && helmRepo.DestinationNamespace == obj.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&prController)})
+		}
+	}
+	return requests
+}
+
+// Filters the events of Jobs and Namespaces down to the objects created by a PREphemeralEnvController, so that the
+// Jobs and Namespaces of the rest of the cluster do not go through the event handlers
+var createdByControllerPredicate = predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	_, ok := obj.GetLabels()[CONTROLLER_NAME_LABEL]
+	return ok
+})
+
+// Filters the updates of HelmReleases down to changes of the spec, labels or annotations, and to changes of the
+// readiness reported by Flux, as Flux updates the status of every HelmRelease each time it reconciles it
+var helmReleaseChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldHelmRel, ok := e.ObjectOld.(*fluxhelmrelease.HelmRelease)
+		if !ok {
+			return true
+		}
+		newHelmRel, ok := e.ObjectNew.(*fluxhelmrelease.HelmRelease)
+		if !ok {
+			return true
+		}
+		if oldHelmRel.Generation != newHelmRel.Generation ||
+			oldHelmRel.Status.ObservedGeneration != newHelmRel.Status.ObservedGeneration ||
+			!reflect.DeepEqual(oldHelmRel.Labels, newHelmRel.Labels) ||
+			!reflect.DeepEqual(oldHelmRel.Annotations, newHelmRel.Annotations) {
+			return true
+		}
+		oldReady := apimeta.FindStatusCondition(oldHelmRel.Status.Conditions, fluxmeta.ReadyCondition)
+		newReady := apimeta.FindStatusCondition(newHelmRel.Status.Conditions, fluxmeta.ReadyCondition)
+		if oldReady == nil || newReady == nil {
+			return oldReady != newReady
+		}
+		return oldReady.Status != newReady.Status || oldReady.Reason != newReady.Reason
+	},
+}
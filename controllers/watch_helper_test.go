@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestMapHelmReleaseToPRController(t *testing.T) {
+	scheme := newTestScheme(t)
+	appA, _ := newTestPRController("app-a")
+	appB, _ := newTestPRController("app-b")
+	// app-b shares the destination namespace of app-a
+	appB.Spec.EnvCreationHelmRepo.DestinationNamespace = appA.Spec.EnvCreationHelmRepo.DestinationNamespace
+	appC, _ := newTestPRController("app-c")
+	r := &PREphemeralEnvControllerReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(appA, appB, appC).Build(),
+		Scheme: scheme,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		helmRel  metav1.ObjectMeta
+		expected []string
+	}{
+		{
+			name:     "labeled",
+			helmRel:  metav1.ObjectMeta{Name: FLUX_HELM_RELEASE_PREFIX + "1", Namespace: "envs-app-a", Labels: getPRLabels(appC, 1)},
+			expected: []string{"default/app-c"},
+		},
+		{
+			name:     "unlabeled in a destination namespace",
+			helmRel:  metav1.ObjectMeta{Name: FLUX_HELM_RELEASE_PREFIX + "1", Namespace: "envs-app-a"},
+			expected: []string{"default/app-a", "default/app-b"},
+		},
+		{
+			name:    "unlabeled in another namespace",
+			helmRel: metav1.ObjectMeta{Name: FLUX_HELM_RELEASE_PREFIX + "1", Namespace: "other"},
+		},
+		{
+			name:    "unlabeled without the release prefix",
+			helmRel: metav1.ObjectMeta{Name: "podinfo", Namespace: "envs-app-a"},
+		},
+		{
+			name:    "partially labeled",
+			helmRel: metav1.ObjectMeta{Name: "podinfo", Namespace: "envs-app-a", Labels: map[string]string{CONTROLLER_NAME_LABEL: "app-a"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mapped []string
+			for _, req := range r.mapHelmReleaseToPRController(&fluxhelmrelease.HelmRelease{ObjectMeta: tc.helmRel}) {
+				mapped = append(mapped, req.String())
+			}
+			sort.Strings(mapped)
+			if !reflect.DeepEqual(mapped, tc.expected) {
+				t.Errorf("expected the HelmRelease to be mapped to %v, got %v", tc.expected, mapped)
+			}
+		})
+	}
+}
+
+func TestCreatedByControllerPredicate(t *testing.T) {
+	prController, _ := newTestPRController("app")
+	for _, tc := range []struct {
+		name     string
+		obj      client.Object
+		expected bool
+	}{
+		{name: "hook Job", obj: &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "hook", Labels: getPRLabels(prController, 1)}}, expected: true},
+		{name: "PR namespace", obj: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "pr-1", Labels: getPRLabels(prController, 1)}}, expected: true},
+		{name: "other Job", obj: &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "backup", Labels: map[string]string{"app": "backup"}}}},
+		{name: "other namespace", obj: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if create := createdByControllerPredicate.Create(event.CreateEvent{Object: tc.obj}); create != tc.expected {
+				t.Errorf("expected create events to pass %v, got %v", tc.expected, create)
+			}
+			if update := createdByControllerPredicate.Update(event.UpdateEvent{ObjectOld: tc.obj, ObjectNew: tc.obj}); update != tc.expected {
+				t.Errorf("expected update events to pass %v, got %v", tc.expected, update)
+			}
+			if deleted := createdByControllerPredicate.Delete(event.DeleteEvent{Object: tc.obj}); deleted != tc.expected {
+				t.Errorf("expected delete events to pass %v, got %v", tc.expected, deleted)
+			}
+		})
+	}
+}
@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -35,6 +37,7 @@ import (
 	fluxhelmrelease "github.com/fluxcd/helm-controller/api/v2beta1"
 	prcontrollerephemeralenviov1alpha1 "github.com/manisbindra/pr-ephemeral-env-controller/api/v1alpha1"
 	"github.com/manisbindra/pr-ephemeral-env-controller/controllers"
+	"go.opentelemetry.io/otel"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -57,8 +60,27 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var healthProbeWorkers int
+	var maxConcurrentReconciles int
+	var bindableClusterRoles string
+	var secretSourceNamespaces string
+	var otlpEndpoint string
+	var otlpInsecure bool
+	var traceSampleRatio float64
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.IntVar(&healthProbeWorkers, "health-probe-workers", controllers.DEFAULT_HEALTH_PROBE_WORKERS,
+		"The number of workers probing the health checks of the PR environments in the background.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of PREphemeralEnvControllers which are reconciled at once.")
+	flag.StringVar(&bindableClusterRoles, "bindable-cluster-roles", strings.Join(controllers.DEFAULT_BINDABLE_CLUSTER_ROLES, ","),
+		"Comma separated ClusterRoles which the roleBindings of the PR namespaces can bind. The controller must also be granted the bind verb on them.")
+	flag.StringVar(&secretSourceNamespaces, "secret-source-namespaces", "",
+		"Comma separated namespaces, besides the namespace of each PREphemeralEnvController, from which the valuesFrom Secrets can be copied.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"The host:port of the OTLP gRPC endpoint traces are exported to. Tracing is disabled if not set.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Export traces to the OTLP endpoint without TLS.")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "The ratio of reconciles which are traced, between 0 and 1.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -70,6 +92,20 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if otlpEndpoint != "" {
+		tracerProvider, err := controllers.NewOTLPTracerProvider(context.Background(), otlpEndpoint, otlpInsecure, traceSampleRatio)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		otel.SetTracerProvider(tracerProvider)
+		defer func() {
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				setupLog.Error(err, "unable to flush traces")
+			}
+		}()
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -95,9 +131,14 @@ func main() {
 	}
 
 	if err = (&controllers.PREphemeralEnvControllerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Record: mgr.GetEventRecorderFor("pr-ephem-env-controller-controller"),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Record:                  mgr.GetEventRecorderFor("pr-ephem-env-controller-controller"),
+		Config:                  mgr.GetConfig(),
+		HealthProbeWorkers:      healthProbeWorkers,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		BindableClusterRoles:    strings.Split(bindableClusterRoles, ","),
+		SecretSourceNamespaces:  strings.Split(secretSourceNamespaces, ","),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PREphemeralEnvController")
 		os.Exit(1)